@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"github.com/machinebox/sdk-go/facebox"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+	"image"
+	"image/color"
+	"image/draw"
+	"path/filepath"
+)
+
+// The colours of the boxes drawn around each face in the annotated pictures.
+var (
+	// recognizedColor is used for the faces of the people we want to recognize.
+	recognizedColor = color.RGBA{R: 0x2e, G: 0xcc, B: 0x40, A: 0xff}
+
+	// belowThresholdColor is used for the faces facebox matched with a confidence lower than config.Confidence.
+	belowThresholdColor = color.RGBA{R: 0xff, G: 0x85, B: 0x1b, A: 0xff}
+
+	// unknownColor is used for the faces facebox couldn't match with the people we want to recognize.
+	unknownColor = color.RGBA{R: 0xff, G: 0x41, B: 0x36, A: 0xff}
+)
+
+// annotatePicture draws the rect, name and confidence of each face onto an upright copy of the
+// given picture and stores it with the given name in config.ReviewDir, so a reviewer can see why
+// a picture was or wasn't classified.
+func annotatePicture(conf *config, pic *picture, name string, faces []facebox.Face) error {
+	raw := pic.img.Bounds()
+	upright := applyOrientation(pic.img, pic.orientation)
+	canvas := image.NewRGBA(image.Rect(0, 0, upright.Bounds().Dx(), upright.Bounds().Dy()))
+	draw.Draw(canvas, canvas.Bounds(), upright, upright.Bounds().Min, draw.Src)
+
+	// The boxes and labels should be visible in small and big pictures alike.
+	scale := canvas.Bounds().Dx() / 800
+	if scale < 1 {
+		scale = 1
+	}
+
+	for _, face := range faces {
+		if face.Rect.Width <= 0 || face.Rect.Height <= 0 {
+			continue
+		}
+		col, label := unknownColor, "unknown"
+		switch {
+		case recognized(conf, face):
+			col, label = recognizedColor, fmt.Sprintf("%s %.2f", face.Name, face.Confidence)
+		case face.Matched && face.Confidence < conf.Confidence:
+			col, label = belowThresholdColor, fmt.Sprintf("%s %.2f", face.Name, face.Confidence)
+		case face.Matched:
+			label = fmt.Sprintf("%s %.2f", face.Name, face.Confidence)
+		}
+		r := orientRect(face.Rect, raw.Dx(), raw.Dy(), pic.orientation)
+		drawBox(canvas, r, col, 2*scale)
+		drawLabel(canvas, r, label, col, scale)
+	}
+
+	return saveImage(filepath.Join(conf.resolve(conf.ReviewDir), name), canvas, "jpeg")
+}
+
+// annotationName returns the name of the annotated copy of the frame with the given index of
+// the picture located in the given path. Annotated copies are always JPEG. See frameName.
+func annotationName(path string, frame int) string {
+	return frameName(path, frame) + ".jpg"
+}
+
+// orientRect converts the given face rect in the coordinates of the stored pixels of a w x h
+// picture to the coordinates of the upright picture after applying the given EXIF orientation.
+func orientRect(r facebox.Rect, w, h, orientation int) image.Rectangle {
+	x0, y0 := orientedDestination(r.Left, r.Top, w, h, orientation)
+	x1, y1 := orientedDestination(r.Left+r.Width-1, r.Top+r.Height-1, w, h, orientation)
+	// image.Rect swaps the corners if needed, but the rect should include the pixels of both corners.
+	rect := image.Rect(x0, y0, x1, y1)
+	return image.Rect(rect.Min.X, rect.Min.Y, rect.Max.X+1, rect.Max.Y+1)
+}
+
+// orientedDestination returns the coordinates in the upright picture of the pixel in the
+// coordinates x, y of a w x h picture after applying the given EXIF orientation. It is the
+// inverse of orientedSource.
+func orientedDestination(x, y, w, h, orientation int) (int, int) {
+	switch orientation {
+	case 2:
+		return w - 1 - x, y
+	case 3:
+		return w - 1 - x, h - 1 - y
+	case 4:
+		return x, h - 1 - y
+	case 5:
+		return y, x
+	case 6:
+		return h - 1 - y, x
+	case 7:
+		return h - 1 - y, w - 1 - x
+	case 8:
+		return y, w - 1 - x
+	}
+	return x, y
+}
+
+// drawBox draws the outline of the given rect onto img with the given colour and thickness.
+func drawBox(img draw.Image, r image.Rectangle, col color.Color, thickness int) {
+	src := image.NewUniform(col)
+	sides := []image.Rectangle{
+		image.Rect(r.Min.X, r.Min.Y, r.Max.X, r.Min.Y+thickness),
+		image.Rect(r.Min.X, r.Max.Y-thickness, r.Max.X, r.Max.Y),
+		image.Rect(r.Min.X, r.Min.Y, r.Min.X+thickness, r.Max.Y),
+		image.Rect(r.Max.X-thickness, r.Min.Y, r.Max.X, r.Max.Y),
+	}
+	for _, side := range sides {
+		draw.Draw(img, side.Intersect(img.Bounds()), src, image.Point{}, draw.Src)
+	}
+}
+
+// drawLabel draws the given text on a background of the given colour right above the given
+// rect, or right below its top edge if there is no room above it. The text is drawn with the
+// bundled basicfont and enlarged by the given scale.
+func drawLabel(img draw.Image, r image.Rectangle, text string, col color.Color, scale int) {
+	face := basicfont.Face7x13
+	const padding = 2
+	w := font.MeasureString(face, text).Ceil() + 2*padding
+	h := face.Height + 2*padding
+
+	label := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.Draw(label, label.Bounds(), image.NewUniform(col), image.Point{}, draw.Src)
+	d := &font.Drawer{
+		Dst:  label,
+		Src:  image.White,
+		Face: face,
+		Dot:  fixed.P(padding, padding+face.Ascent),
+	}
+	d.DrawString(text)
+
+	origin := image.Pt(r.Min.X, r.Min.Y-h*scale)
+	if origin.Y < 0 {
+		origin.Y = r.Min.Y
+	}
+	bounds := img.Bounds()
+	for y := 0; y < h*scale; y++ {
+		for x := 0; x < w*scale; x++ {
+			p := origin.Add(image.Pt(x, y))
+			if p.In(bounds) {
+				img.Set(p.X, p.Y, label.At(x/scale, y/scale))
+			}
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"github.com/machinebox/sdk-go/facebox"
+	"image"
+	"image/color"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func Test_orientRect(t *testing.T) {
+	r := facebox.Rect{Top: 0, Left: 0, Width: 10, Height: 5}
+
+	// A 40x20 picture rotated 90 degrees clockwise becomes a 20x40 picture where the top
+	// left corner of the stored pixels ends up in the top right corner.
+	got := orientRect(r, 40, 20, 6)
+	want := image.Rect(15, 0, 20, 10)
+	if got != want {
+		t.Errorf("expected rect %v; got %v", want, got)
+	}
+
+	got = orientRect(r, 40, 20, 1)
+	want = image.Rect(0, 0, 10, 5)
+	if got != want {
+		t.Errorf("expected rect %v; got %v", want, got)
+	}
+}
+
+// closeTo checks whether the given colours are about the same, since JPEG is lossy.
+func closeTo(a, b color.Color) bool {
+	ar, ag, ab, _ := a.RGBA()
+	br, bg, bb, _ := b.RGBA()
+	diff := func(x, y uint32) uint32 {
+		if x > y {
+			return x - y
+		}
+		return y - x
+	}
+	return diff(ar, br) < 0x2000 && diff(ag, bg) < 0x2000 && diff(ab, bb) < 0x2000
+}
+
+func Test_annotatePicture(t *testing.T) {
+	dir, err := ioutil.TempDir("", "coalescer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c, err := newConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.People = PeopleToIdentify{"bill": nil, "mark": nil}
+	c.Confidence = 0.5
+	c.ReviewDir = dir
+	c.WorkingDir = ""
+
+	faces := []facebox.Face{
+		{Rect: facebox.Rect{Top: 100, Left: 100, Width: 200, Height: 200}, Name: "bill", Matched: true, Confidence: 0.7},
+		{Rect: facebox.Rect{Top: 100, Left: 600, Width: 200, Height: 200}, Name: "mark", Matched: true, Confidence: 0.3},
+		{Rect: facebox.Rect{Top: 450, Left: 600, Width: 200, Height: 200}},
+	}
+	pic, err := loadPicture("pics_dir/mark_and_bill.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := annotatePicture(c, pic, "mark_and_bill.jpg", faces); err != nil {
+		t.Fatalf("annotatePicture shouldn't fail; got error %s", err)
+	}
+
+	f, err := os.Open(filepath.Join(dir, "mark_and_bill.jpg"))
+	if err != nil {
+		t.Fatalf("the annotated picture should exist in the review dir")
+	}
+	defer f.Close()
+	img, _, err := image.Decode(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Let's check the colour of the bottom edge of each box, where there is no label.
+	boxes := []struct {
+		point image.Point
+		color color.Color
+	}{
+		{image.Pt(200, 299), recognizedColor},
+		{image.Pt(700, 299), belowThresholdColor},
+		{image.Pt(700, 649), unknownColor},
+	}
+	for _, box := range boxes {
+		if got := img.At(box.point.X, box.point.Y); !closeTo(got, box.color) {
+			t.Errorf("expected colour %v at %v; got %v", box.color, box.point, got)
+		}
+	}
+}
+
+func Test_annotationName(t *testing.T) {
+	scenarios := map[string]struct {
+		path  string
+		frame int
+	}{
+		"mark_and_bill.jpg":   {"pics_dir/mark_and_bill.jpg", 0},
+		"bill_gates_3.jpg":    {"people_dir/bill_gates_3.png", 0},
+		"party.jpg":           {"backup.zip/2019/party.gif", 0},
+		"party_frame3.jpg":    {"backup.zip/2019/party.gif", 3},
+		"scan.2019_frame.jpg": {"scans/scan.2019_frame.tiff", 0},
+	}
+	for want, s := range scenarios {
+		if got := annotationName(s.path, s.frame); got != want {
+			t.Errorf("expected the annotation of frame %d of %s to be %s; got %s", s.frame, s.path, want, got)
+		}
+	}
+}
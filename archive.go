@@ -0,0 +1,306 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// item represents a file coalescer should check. The pictures inside archives carry their
+// content, since they cannot be opened on their own. Their paths are made of the path of
+// the archive followed by their path inside the archive, e.g. backup.zip/2019/beach.jpg.
+// The files inside archives that aren't extracted carry why instead, see sendArchive.
+type item struct {
+	path    string
+	data    []byte
+	skipped string
+	err     error
+}
+
+// maxArchiveEntrySize is the size of the largest file coalescer extracts from an archive to
+// check it. Every file being checked is kept in memory, so larger files fail instead.
+var maxArchiveEntrySize int64 = 256 << 20
+
+// isArchive checks whether the file with the given name is an archive coalescer can read.
+func isArchive(name string) bool {
+	name = strings.ToLower(name)
+	for _, ext := range []string{".zip", ".tar", ".tar.gz", ".tgz"} {
+		if strings.HasSuffix(name, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// errStopArchive is returned by the functions given to walkArchive to stop walking the archive.
+var errStopArchive = errors.New("stop walking the archive")
+
+// archiveWalkFunc is the type of the function called by walkArchive for each regular file inside
+// an archive, with the cleaned slash separated path of the file inside the archive, its size and
+// a function to open it.
+type archiveWalkFunc func(name string, size int64, open func() (io.ReadCloser, error)) error
+
+// walkArchive calls fn for each regular file inside the archive located in the given path.
+func walkArchive(archive string, fn archiveWalkFunc) error {
+	var err error
+	if strings.HasSuffix(strings.ToLower(archive), ".zip") {
+		err = walkZip(archive, fn)
+	} else {
+		err = walkTar(archive, fn)
+	}
+	if err == errStopArchive {
+		return nil
+	}
+	return err
+}
+
+func walkZip(archive string, fn archiveWalkFunc) error {
+	r, err := zip.OpenReader(archive)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	for _, f := range r.File {
+		if !f.Mode().IsRegular() {
+			continue
+		}
+		if err := fn(cleanEntryName(f.Name), int64(f.UncompressedSize64), f.Open); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func walkTar(archive string, fn archiveWalkFunc) error {
+	file, err := os.Open(archive)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var r io.Reader = file
+	if lower := strings.ToLower(archive); strings.HasSuffix(lower, ".gz") || strings.HasSuffix(lower, ".tgz") {
+		gz, err := gzip.NewReader(file)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeRegA {
+			continue
+		}
+		open := func() (io.ReadCloser, error) { return ioutil.NopCloser(tr), nil }
+		if err := fn(cleanEntryName(hdr.Name), hdr.Size, open); err != nil {
+			return err
+		}
+	}
+}
+
+// cleanEntryName returns the given name of a file inside an archive without any ./ or / prefix.
+func cleanEntryName(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+name), "/")
+}
+
+// sendArchive sends every file inside the archive located in the given path that the given filter
+// doesn't skip to send. The filter sees the files as if the archive was a directory. The files are
+// streamed from the archive and only the ones that look like pictures coalescer should check are
+// extracted, so videos and other large files are never kept in memory. See skipReason.
+func sendArchive(conf *config, archive string, filter *walkFilter, send func(item) error) error {
+	return walkArchive(archive, func(name string, size int64, open func() (io.ReadCloser, error)) error {
+		p := filepath.Join(archive, filepath.FromSlash(name))
+		if filter.skipEntry(p) {
+			return nil
+		}
+		r, err := open()
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+
+		header := make([]byte, 16)
+		n, err := io.ReadFull(r, header)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return fmt.Errorf("couldn't read %s; got error %s", p, err)
+		}
+		header = header[:n]
+		skipped, err := skipReason(conf, p, bytes.NewReader(header))
+		if err != nil {
+			return err
+		}
+		if skipped != "" {
+			return send(item{path: p, skipped: skipped})
+		}
+		if size > maxArchiveEntrySize {
+			return send(item{path: p, err: fmt.Errorf("the file is larger than the %d MB coalescer extracts from archives", maxArchiveEntrySize>>20)})
+		}
+
+		// The size in the header of the archive might be wrong, so we don't trust it.
+		rest, err := ioutil.ReadAll(io.LimitReader(r, maxArchiveEntrySize-int64(n)+1))
+		if err != nil {
+			return fmt.Errorf("couldn't read %s; got error %s", p, err)
+		}
+		if int64(n+len(rest)) > maxArchiveEntrySize {
+			return send(item{path: p, err: fmt.Errorf("the file is larger than the %d MB coalescer extracts from archives", maxArchiveEntrySize>>20)})
+		}
+		return send(item{path: p, data: append(header, rest...)})
+	})
+}
+
+// splitArchivePath splits the given path of a file inside an archive into the path of the
+// archive and the slash separated path of the file inside it. It returns false if the path
+// doesn't point inside an archive.
+func splitArchivePath(p string) (string, string, bool) {
+	p = filepath.Clean(p)
+	for i := 0; i < len(p); i++ {
+		if p[i] != filepath.Separator || !isArchive(p[:i]) {
+			continue
+		}
+		if info, err := os.Stat(p[:i]); err == nil && info.Mode().IsRegular() {
+			return p[:i], filepath.ToSlash(p[i+1:]), true
+		}
+	}
+	return "", "", false
+}
+
+// readArchiveEntry returns the content of the file with the given name inside the given archive.
+func readArchiveEntry(archive, name string) ([]byte, error) {
+	var data []byte
+	found := false
+	err := walkArchive(archive, func(entry string, size int64, open func() (io.ReadCloser, error)) error {
+		if entry != name {
+			return nil
+		}
+		r, err := open()
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		data, err = ioutil.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		found = true
+		return errStopArchive
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, fmt.Errorf("there is no file %s in the archive %s", name, archive)
+	}
+	return data, nil
+}
+
+// pendingEntries maps the paths of the files inside archives that are being checked to their
+// content, so they don't have to be read from their archives again every time they are opened.
+var pendingEntries sync.Map
+
+// extractedEntries keeps the content of the files inside archives that were checked in a
+// temporary directory, so the steps that run after checking them, like the gallery or the
+// unknown faces, don't read and decompress their archives again for each of them. It's safe
+// to use an extractedEntries from several goroutines.
+type extractedEntries struct {
+	dir   string
+	mu    sync.Mutex
+	paths map[string]string
+}
+
+func newExtractedEntries() (*extractedEntries, error) {
+	dir, err := ioutil.TempDir("", "coalescer")
+	if err != nil {
+		return nil, err
+	}
+	return &extractedEntries{dir: dir, paths: make(map[string]string)}, nil
+}
+
+// store writes the given content of the file inside an archive located in the given path to
+// the temporary directory.
+func (e *extractedEntries) store(p string, data []byte) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	tmp := filepath.Join(e.dir, fmt.Sprintf("%d%s", len(e.paths), path.Ext(p)))
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	e.paths[filepath.Clean(p)] = tmp
+	return nil
+}
+
+// lookup returns the temporary file the file inside an archive located in the given path
+// was extracted to, if any.
+func (e *extractedEntries) lookup(p string) (string, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	tmp, ok := e.paths[filepath.Clean(p)]
+	return tmp, ok
+}
+
+// close removes the temporary directory.
+func (e *extractedEntries) close() error {
+	return os.RemoveAll(e.dir)
+}
+
+// _extracted holds the files inside archives extracted during this run. It's only set when a
+// step that runs after checking the pictures needs them, see run.
+var _extracted *extractedEntries
+
+// readSeekCloser is the interface that groups the basic Read, Seek and Close methods.
+type readSeekCloser interface {
+	io.ReadSeeker
+	io.Closer
+}
+
+// entryReader is a readSeekCloser for the content of a file inside an archive.
+type entryReader struct {
+	*bytes.Reader
+}
+
+func (entryReader) Close() error {
+	return nil
+}
+
+// openFile opens the file located in the given path, which can also be the path of a file
+// inside an archive, e.g. backup.zip/2019/beach.jpg.
+func openFile(p string) (readSeekCloser, error) {
+	if data, ok := pendingEntries.Load(filepath.Clean(p)); ok {
+		return entryReader{bytes.NewReader(data.([]byte))}, nil
+	}
+	if _extracted != nil {
+		if tmp, ok := _extracted.lookup(p); ok {
+			return os.Open(tmp)
+		}
+	}
+	file, err := os.Open(p)
+	if err == nil {
+		return file, nil
+	}
+	archive, name, ok := splitArchivePath(p)
+	if !ok {
+		return nil, err
+	}
+	data, err := readArchiveEntry(archive, name)
+	if err != nil {
+		return nil, err
+	}
+	return entryReader{bytes.NewReader(data)}, nil
+}
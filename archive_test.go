@@ -0,0 +1,287 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+// writeZip writes a zip archive in the given path with the given files.
+func writeZip(t *testing.T, path string, files map[string][]byte) {
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	for name, b := range files {
+		f, err := w.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.Write(b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// writeTarGz writes a gzipped tar archive in the given path with the given files.
+func writeTarGz(t *testing.T, path string, files map[string][]byte) {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	w := tar.NewWriter(gz)
+	for name, b := range files {
+		if err := w.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(b)), Typeflag: tar.TypeReg}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write(b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_recognizePictures_in_archives(t *testing.T) {
+	dir, err := ioutil.TempDir("", "coalescer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	billAndSteve, err := ioutil.ReadFile("pics_dir/bill_and_steve.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	markAndBill, err := ioutil.ReadFile("pics_dir/mark_and_bill.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	picsDir := filepath.Join(dir, "pics")
+	if err := os.Mkdir(picsDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeZip(t, filepath.Join(picsDir, "backup.zip"), map[string][]byte{
+		"2019/mark_and_bill.jpg": markAndBill,
+		"2019/.DS_Store":         []byte("Bud1"),
+	})
+	writeTarGz(t, filepath.Join(picsDir, "export.tar.gz"), map[string][]byte{
+		"./photos/bill_and_steve.jpg": billAndSteve,
+	})
+
+	c, err := newConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.WorkingDir = dir
+	c.PicsDirs = stringList{picsDir}
+	c.People = PeopleToIdentify{"bill": nil, "mark": nil}
+	c.Confidence = 0.5
+	if err := createFoldersForPeople(c); err != nil {
+		t.Fatal(err)
+	}
+
+	originalFacebox := fbox
+	fbox = &mockRecognizer{}
+	defer func(original recognizer) {
+		fbox = original
+	}(originalFacebox)
+
+	done := make(chan struct{})
+	defer close(done)
+	ch, errc := recognizePictures(c, done)
+	results := make(map[string]result)
+	for re := range ch {
+		rel, err := filepath.Rel(picsDir, re.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		results[filepath.ToSlash(rel)] = re
+	}
+	if err := <-errc; err != nil {
+		t.Fatalf("recognizePictures shouldn't fail; got error %s", err)
+	}
+
+	var paths []string
+	for p := range results {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	want := []string{"backup.zip/2019/.DS_Store", "backup.zip/2019/mark_and_bill.jpg", "export.tar.gz/photos/bill_and_steve.jpg"}
+	if len(paths) != len(want) {
+		t.Fatalf("expected the results of %v; got %v", want, paths)
+	}
+	for i := range want {
+		if paths[i] != want[i] {
+			t.Fatalf("expected the results of %v; got %v", want, paths)
+		}
+	}
+	if results[want[0]].skipped == "" {
+		t.Errorf("the .DS_Store inside the archive should be skipped")
+	}
+	for _, p := range want[1:] {
+		if re := results[p]; re.err != nil {
+			t.Errorf("%s shouldn't fail; got error %s", p, re.err)
+		}
+	}
+
+	// Only the pictures that match are extracted.
+	extracted := map[string][]byte{
+		"bill/mark_and_bill.jpg":  markAndBill,
+		"mark/mark_and_bill.jpg":  markAndBill,
+		"bill/bill_and_steve.jpg": billAndSteve,
+	}
+	for p, b := range extracted {
+		got, err := ioutil.ReadFile(filepath.Join(dir, filepath.FromSlash(p)))
+		if err != nil || !bytes.Equal(got, b) {
+			t.Errorf("%s should be extracted from its archive", p)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "bill", ".DS_Store")); !os.IsNotExist(err) {
+		t.Errorf("files that don't match shouldn't be extracted")
+	}
+
+	// The pictures inside archives can be opened later on too, e.g. to crop unknown faces.
+	pic, err := loadPicture(filepath.Join(picsDir, "export.tar.gz", "photos", "bill_and_steve.jpg"))
+	if err != nil {
+		t.Fatalf("loadPicture should open a picture inside an archive; got error %s", err)
+	}
+	if pic.img.Bounds().Empty() {
+		t.Errorf("expected a picture")
+	}
+}
+
+func Test_sendArchive_only_extracts_pictures(t *testing.T) {
+	dir, err := ioutil.TempDir("", "coalescer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	markAndBill, err := ioutil.ReadFile("pics_dir/mark_and_bill.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive := filepath.Join(dir, "export.zip")
+	writeZip(t, archive, map[string][]byte{
+		"mark_and_bill.jpg": markAndBill,
+		"video.mp4":         bytes.Repeat([]byte{0, 0, 0, 0x20, 'f', 't', 'y', 'p'}, 1<<16),
+		"party.gif":         []byte("GIF89a"),
+	})
+
+	c, err := newConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	items := make(map[string]item)
+	send := func(it item) error {
+		rel, err := filepath.Rel(archive, it.path)
+		if err != nil {
+			return err
+		}
+		items[filepath.ToSlash(rel)] = it
+		return nil
+	}
+	if err := sendArchive(c, archive, nil, send); err != nil {
+		t.Fatalf("sendArchive shouldn't fail; got error %s", err)
+	}
+
+	if it := items["mark_and_bill.jpg"]; !bytes.Equal(it.data, markAndBill) || it.skipped != "" {
+		t.Errorf("the pictures inside the archive should be extracted")
+	}
+	for _, name := range []string{"video.mp4", "party.gif"} {
+		if it := items[name]; it.skipped == "" || it.data != nil {
+			t.Errorf("%s shouldn't be extracted, since it isn't an allowed picture; got %d bytes", name, len(it.data))
+		}
+	}
+
+	// Pictures larger than the limit fail without being extracted.
+	defer func(original int64) {
+		maxArchiveEntrySize = original
+	}(maxArchiveEntrySize)
+	maxArchiveEntrySize = 1024
+	items = make(map[string]item)
+	if err := sendArchive(c, archive, nil, send); err != nil {
+		t.Fatalf("sendArchive shouldn't fail; got error %s", err)
+	}
+	if it := items["mark_and_bill.jpg"]; it.err == nil || it.data != nil {
+		t.Errorf("pictures larger than the limit shouldn't be extracted")
+	}
+}
+
+func Test_recognizePictures_keeps_extracted_pictures(t *testing.T) {
+	dir, err := ioutil.TempDir("", "coalescer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	billAndSteve, err := ioutil.ReadFile("pics_dir/bill_and_steve.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	picsDir := filepath.Join(dir, "pics")
+	if err := os.Mkdir(picsDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	archive := filepath.Join(picsDir, "export.tar.gz")
+	writeTarGz(t, archive, map[string][]byte{"photos/bill_and_steve.jpg": billAndSteve})
+
+	c, err := newConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.WorkingDir = dir
+	c.PicsDirs = stringList{picsDir}
+	c.People = PeopleToIdentify{"bill": nil, "mark": nil}
+	c.Confidence = 0.5
+	if err := createFoldersForPeople(c); err != nil {
+		t.Fatal(err)
+	}
+
+	originalFacebox := fbox
+	fbox = &mockRecognizer{}
+	defer func(original recognizer) {
+		fbox = original
+	}(originalFacebox)
+	_extracted, err = newExtractedEntries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_extracted.close()
+		_extracted = nil
+	}()
+
+	done := make(chan struct{})
+	defer close(done)
+	ch, errc := recognizePictures(c, done)
+	for range ch {
+	}
+	if err := <-errc; err != nil {
+		t.Fatalf("recognizePictures shouldn't fail; got error %s", err)
+	}
+
+	// Let's make sure the picture isn't read from its archive again.
+	if err := ioutil.WriteFile(archive, []byte("not an archive anymore"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadPicture(filepath.Join(archive, "photos", "bill_and_steve.jpg")); err != nil {
+		t.Errorf("expected the picture to be opened from where it was extracted; got error %s", err)
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"github.com/machinebox/sdk-go/facebox"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// promoteCommandName is the name of the subcommand that promotes a cluster of unknown faces
+// to a person in peopledir.
+const promoteCommandName = "promote"
+
+// The names of the files inside each cluster folder.
+const (
+	clusterSourcesFile = "sources.txt"
+	clusterFacePrefix  = "face_"
+)
+
+// unknownFace represents a face facebox couldn't match with anyone, and the picture and frame
+// it was found in.
+type unknownFace struct {
+	path  string
+	frame int
+	face  facebox.Face
+}
+
+// faceCluster represents a group of unknown faces that probably belong to the same person.
+type faceCluster struct {
+	faces []unknownFace
+}
+
+// collectUnknownFaces returns the faces of the given results that facebox couldn't match
+// with anyone, sorted by the paths of their pictures.
+func collectUnknownFaces(results []result) []unknownFace {
+	var unknown []unknownFace
+	for _, re := range results {
+		for _, face := range re.faces {
+			if !face.Matched && face.Faceprint != "" {
+				unknown = append(unknown, unknownFace{path: re.path, frame: re.frame, face: face})
+			}
+		}
+	}
+	sort.SliceStable(unknown, func(i, j int) bool {
+		return unknown[i].path < unknown[j].path
+	})
+	return unknown
+}
+
+// clusterFaces groups the given faces by the similarity of their faceprints. Each face joins
+// the cluster whose first face is the most similar to it, as long as facebox is at least as
+// confident as the given similarity that both faces belong to the same person; otherwise the
+// face starts a new cluster.
+func clusterFaces(faces []unknownFace, similarity float64) ([]*faceCluster, error) {
+	var clusters []*faceCluster
+	var representatives []string
+	for _, f := range faces {
+		best, bestConfidence := -1, 0.0
+		if len(representatives) > 0 {
+			confidences, err := fbox.CompareFaceprints(f.face.Faceprint, representatives)
+			if err != nil {
+				return nil, err
+			}
+			for i, confidence := range confidences {
+				if confidence >= similarity && confidence > bestConfidence {
+					best, bestConfidence = i, confidence
+				}
+			}
+		}
+		if best == -1 {
+			clusters = append(clusters, &faceCluster{})
+			representatives = append(representatives, f.face.Faceprint)
+			best = len(clusters) - 1
+		}
+		clusters[best].faces = append(clusters[best].faces, f)
+	}
+	return clusters, nil
+}
+
+// clusterDirPattern matches the names of the folders saveUnknownFaces creates.
+var clusterDirPattern = regexp.MustCompile(`^cluster_[0-9]{2,}$`)
+
+// removePreviousClusters removes the cluster folders a previous run left in the given dir.
+// Anything else in the dir is left untouched, including folders named like clusters that
+// don't have a sources file.
+func removePreviousClusters(dir string) error {
+	entries, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() || !clusterDirPattern.MatchString(entry.Name()) {
+			continue
+		}
+		cluster := filepath.Join(dir, entry.Name())
+		if _, err := os.Stat(filepath.Join(cluster, clusterSourcesFile)); err != nil {
+			continue
+		}
+		if err := os.RemoveAll(cluster); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// saveUnknownFaces clusters the unknown faces of the given results and writes each cluster
+// in its own folder inside config.UnknownDir, e.g. _unknown/cluster_07/. Each folder contains
+// the cropped faces of the cluster and a sources.txt file with the picture of each face.
+func saveUnknownFaces(c *config, results []result) error {
+	unknown := collectUnknownFaces(results)
+	clusters, err := clusterFaces(unknown, c.UnknownSimilarity)
+	if err != nil {
+		return err
+	}
+
+	// The clusters of a previous run are meaningless now.
+	unknownDir := c.resolve(c.UnknownDir)
+	if err := removePreviousClusters(unknownDir); err != nil {
+		return err
+	}
+
+	for i, cluster := range clusters {
+		dir := filepath.Join(unknownDir, fmt.Sprintf("cluster_%02d", i+1))
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+
+		var sources bytes.Buffer
+		pictures := make(map[unknownFace]*picture)
+		for j, f := range cluster.faces {
+			source := unknownFace{path: f.path, frame: f.frame}
+			pic, ok := pictures[source]
+			if !ok {
+				pic, err = loadPictureFrame(c.resolve(f.path), f.frame)
+				if err != nil {
+					return err
+				}
+				pictures[source] = pic
+			}
+			name := fmt.Sprintf("%s%02d.jpg", clusterFacePrefix, j+1)
+			if err := saveImage(filepath.Join(dir, name), pic.cropFace(f.face.Rect, 0.2), "jpeg"); err != nil {
+				return err
+			}
+			fmt.Fprintf(&sources, "%s\t%s\n", name, f.path)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, clusterSourcesFile), sources.Bytes(), 0644); err != nil {
+			return err
+		}
+	}
+
+	fmt.Printf("Found %d unknown faces in %d clusters; see %s.\n", len(unknown), len(clusters), c.UnknownDir)
+	return nil
+}
+
+// promoteCommand runs the promote subcommand with the given arguments, e.g.:
+//
+//	coalescer promote -peopledir=people_dir _unknown/cluster_07 julia
+//
+// It copies the cropped faces of the cluster to peopledir as pictures of the given person,
+// so the next run will teach them to facebox.
+func promoteCommand(programName string, args []string) int {
+	flags := flag.NewFlagSet(programName, flag.ContinueOnError)
+	var buf bytes.Buffer
+	flags.SetOutput(&buf)
+	c, err := newConfig()
+	if err != nil {
+		return failWith(exitError, err)
+	}
+	flags.StringVar(&c.PeopleDir, peopleDirFlag, "", "Represents the dir where coalescer can find the photos of the people you want to recognize.")
+	if err := flags.Parse(args); err != nil {
+		return failWith(exitConfig, fmt.Errorf("%s\n%s", err, buf.String()))
+	}
+	if flags.NArg() != 2 || c.PeopleDir == "" {
+		return failWith(exitConfig, fmt.Errorf("usage: %s -%s=<dir> <cluster dir> <name>", programName, peopleDirFlag))
+	}
+
+	n, err := promoteCluster(c, flags.Arg(0), flags.Arg(1))
+	if err != nil {
+		return failWith(exitCode(err), err)
+	}
+	fmt.Printf("Promoted %d faces of %s to %s.\n", n, flags.Arg(0), flags.Arg(1))
+	return exitOK
+}
+
+// promoteCluster copies the faces of the cluster in the given dir to config.PeopleDir as
+// pictures of the person with the given name. It returns the number of copied faces.
+func promoteCluster(c *config, clusterDir, name string) (int, error) {
+	if name == "" || strings.ContainsAny(name, "_/\\") {
+		return 0, configError{fmt.Errorf("the name %q cannot be empty nor contain underscores or slashes", name)}
+	}
+
+	files, err := ioutil.ReadDir(clusterDir)
+	if err != nil {
+		return 0, err
+	}
+	cluster := filepath.Base(filepath.Clean(clusterDir))
+
+	n := 0
+	for _, f := range files {
+		if !strings.HasPrefix(f.Name(), clusterFacePrefix) {
+			continue
+		}
+		b, err := ioutil.ReadFile(filepath.Join(clusterDir, f.Name()))
+		if err != nil {
+			return n, err
+		}
+		// The name of the person should come first in the filename. See collectPeoplePics.
+		dst := filepath.Join(c.PeopleDir, fmt.Sprintf("%s_%s_%s", name, cluster, f.Name()))
+		if _, err := os.Stat(dst); err == nil {
+			return n, fmt.Errorf("file %s already exists", dst)
+		}
+		if err := ioutil.WriteFile(dst, b, 0644); err != nil {
+			return n, err
+		}
+		n++
+	}
+	if n == 0 {
+		return 0, fmt.Errorf("there are no faces in %s", clusterDir)
+	}
+	return n, nil
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"github.com/machinebox/sdk-go/facebox"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func Test_saveUnknownFaces_and_promoteCluster(t *testing.T) {
+	dir, err := ioutil.TempDir("", "coalescer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c, err := newConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.UnknownDir = filepath.Join(dir, "_unknown")
+	c.UnknownSimilarity = 0.6
+	c.WorkingDir = ""
+
+	originalFacebox := fbox
+	fbox = &mockRecognizer{}
+	defer func(original recognizer) {
+		fbox = original
+	}(originalFacebox)
+
+	// The mock faceprints of steve's faces are equal, so they should end up in the same cluster.
+	rect := facebox.Rect{Top: 10, Left: 10, Width: 100, Height: 100}
+	results := []result{
+		{
+			path: "pics_dir/bill_and_steve.jpg",
+			faces: []facebox.Face{
+				{Rect: rect, Name: "bill", Matched: true, Faceprint: "faceprint:bill"},
+				{Rect: rect, Faceprint: "faceprint:steve"},
+			},
+		},
+		{
+			path: "pics_dir/mark_and_bill.jpg",
+			faces: []facebox.Face{
+				{Rect: rect, Faceprint: "faceprint:steve"},
+				{Rect: rect, Faceprint: "faceprint:julia"},
+			},
+		},
+	}
+
+	if err := saveUnknownFaces(c, results); err != nil {
+		t.Fatalf("saveUnknownFaces shouldn't fail; got error %s", err)
+	}
+
+	clusters := map[string][]string{
+		"cluster_01": {"face_01.jpg", "face_02.jpg"},
+		"cluster_02": {"face_01.jpg"},
+	}
+	for cluster, faces := range clusters {
+		for _, face := range faces {
+			if _, err := os.Stat(filepath.Join(c.UnknownDir, cluster, face)); os.IsNotExist(err) {
+				t.Errorf("face %s should exist in cluster %s", face, cluster)
+			}
+		}
+	}
+	if _, err := os.Stat(filepath.Join(c.UnknownDir, "cluster_03")); err == nil {
+		t.Errorf("there should be only 2 clusters")
+	}
+
+	sources, err := ioutil.ReadFile(filepath.Join(c.UnknownDir, "cluster_01", clusterSourcesFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{"face_01.jpg\tpics_dir/bill_and_steve.jpg", "face_02.jpg\tpics_dir/mark_and_bill.jpg"} {
+		if !strings.Contains(string(sources), s) {
+			t.Errorf("expected %s to contain %q; got %s", clusterSourcesFile, s, sources)
+		}
+	}
+
+	// Now let's promote the first cluster to steve.
+	c.PeopleDir = filepath.Join(dir, "people")
+	if err := os.Mkdir(c.PeopleDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	n, err := promoteCluster(c, filepath.Join(c.UnknownDir, "cluster_01"), "steve")
+	if err != nil {
+		t.Fatalf("promoteCluster shouldn't fail; got error %s", err)
+	}
+	if n != 2 {
+		t.Errorf("expected 2 faces to be promoted; got %d", n)
+	}
+	if err := collectPeoplePics(c); err != nil {
+		t.Fatalf("the promoted faces should be valid pictures of peopledir; got error %s", err)
+	}
+	if len(c.People["steve"]) != 2 {
+		t.Errorf("expected 2 pictures of steve in peopledir; got %v", c.People)
+	}
+
+	if _, err := promoteCluster(c, filepath.Join(c.UnknownDir, "cluster_02"), "bad_name"); err == nil {
+		t.Errorf("promoteCluster should fail with a name that contains underscores")
+	}
+}
+
+func Test_removePreviousClusters(t *testing.T) {
+	dir, err := ioutil.TempDir("", "coalescer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"cluster_01/" + clusterSourcesFile: "face_01.jpg\tpics/party.jpg\n",
+		"cluster_01/face_01.jpg":           "face",
+		"cluster_12/" + clusterSourcesFile: "",
+		"cluster_02/notes.txt":             "not made by coalescer",
+		"holidays/" + clusterSourcesFile:   "",
+		"beach.jpg":                        "picture",
+	}
+	for name, content := range files {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := removePreviousClusters(dir); err != nil {
+		t.Fatalf("removePreviousClusters shouldn't fail; got error %s", err)
+	}
+	for _, name := range []string{"cluster_01", "cluster_12"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); !os.IsNotExist(err) {
+			t.Errorf("the cluster %s of the previous run should be removed", name)
+		}
+	}
+	for _, name := range []string{"cluster_02/notes.txt", "holidays/" + clusterSourcesFile, "beach.jpg"} {
+		if _, err := os.Stat(filepath.Join(dir, filepath.FromSlash(name))); err != nil {
+			t.Errorf("%s wasn't made by coalescer and should be kept; got error %s", name, err)
+		}
+	}
+
+	if err := removePreviousClusters(filepath.Join(dir, "missing")); err != nil {
+		t.Errorf("removePreviousClusters shouldn't fail when the dir doesn't exist; got error %s", err)
+	}
+}
@@ -1,14 +1,15 @@
 package main
 
 import (
+	"bytes"
+	"encoding/base64"
 	"errors"
-	"flag"
 	"fmt"
 	"github.com/machinebox/sdk-go/boxutil"
 	"github.com/machinebox/sdk-go/facebox"
 	"image"
-	_ "image/jpeg"
-	_ "image/png"
+	"image/jpeg"
+	"image/png"
 	"io"
 	"log"
 	"os"
@@ -20,50 +21,151 @@ import (
 
 type recognizer interface {
 	Teach(image io.Reader, id string, name string) error
+	Remove(id string) error
 	Check(image io.Reader) ([]facebox.Face, error)
+	CheckBase64WithFaceprint(data string) ([]facebox.Face, error)
+	CheckFaceprints(faceprints []string) ([]facebox.Face, error)
+	CompareFaceprints(target string, faceprintCandidates []string) ([]float64, error)
 	Info() (*boxutil.Info, error)
+	OpenState() (io.ReadCloser, error)
+	PostState(r io.Reader) error
 }
 
-var _logger *log.Logger
+// _logger logs to the standard error until the log flags are parsed, see setUpLogger.
+var _logger = newLogger(os.Stderr, levelInfo, logFormatText)
 var fbox recognizer
 
+// sortCommandName is the name of the subcommand that sorts the pictures, which is what coalescer
+// does when no subcommand is given.
+const sortCommandName = "sort"
+
+// subcommands maps the names of the subcommands of coalescer to the functions that run them.
+// Each function returns the exit code of coalescer.
+var subcommands = map[string]func(programName string, args []string) int{
+	stateCommandName:   stateCommand,
+	promoteCommandName: promoteCommand,
+	correctCommandName: correctCommand,
+}
+
 func main() {
-	// Let's configure the logger.
-	logFile, err := os.OpenFile("./coalescer.log", os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
-	if err != nil {
-		log.Fatalln(err)
+	// Let's run the subcommand if the user asked for one.
+	if len(os.Args) > 1 {
+		if cmd, ok := subcommands[os.Args[1]]; ok {
+			os.Exit(cmd(os.Args[0]+" "+os.Args[1], os.Args[2:]))
+		}
+	}
+
+	// Sorting the pictures is what coalescer does by default, so the sort subcommand is optional.
+	programName, args := os.Args[0], os.Args[1:]
+	if len(args) > 0 && args[0] == sortCommandName {
+		programName, args = programName+" "+sortCommandName, args[1:]
+	}
+	os.Exit(sortCommand(programName, args))
+}
+
+// The exit codes of coalescer, so scripts and cron jobs can tell what went wrong.
+const (
+	exitOK              = 0
+	exitError           = 1
+	exitConfig          = 2
+	exitUnreachable     = 3
+	exitTooManyFailures = 4
+)
+
+// configError wraps the errors caused by the configuration of coalescer, like the flags
+// or the pictures in peopledir.
+type configError struct {
+	err error
+}
+
+func (e configError) Error() string {
+	return e.err.Error()
+}
+
+func (e configError) Unwrap() error {
+	return e.err
+}
+
+// exitCode returns the exit code coalescer should exit with after run returned the given error.
+// The errors of facebox on single pictures are counted as failures of those pictures, so a
+// recognizerError only gets to run when facebox fails before the pictures are checked.
+func exitCode(err error) int {
+	var configErr configError
+	var recErr recognizerError
+	var failuresErr *tooManyFailuresError
+	switch {
+	case err == nil:
+		return exitOK
+	case errors.As(err, &configErr):
+		return exitConfig
+	case errors.As(err, &recErr):
+		return exitUnreachable
+	case errors.As(err, &failuresErr):
+		return exitTooManyFailures
 	}
-	_logger = log.New(logFile, "Coalescer Logger:\t", log.Ldate|log.Ltime|log.Lshortfile)
-	defer logFile.Close()
+	return exitError
+}
 
+// failWith logs the given error and returns the given exit code.
+func failWith(code int, err error) int {
+	log.Println(err)
+	return code
+}
+
+// sortCommand sorts the pictures as the given command line arguments say, and returns the
+// exit code of coalescer.
+func sortCommand(programName string, args []string) int {
 	// Let's parse the flags.
-	conf, output, err := parseFlags(os.Args[0], os.Args[1:])
-	if err == flag.ErrHelp {
-		fmt.Println("output:\n", output)
-		os.Exit(2)
-	} else if err != nil {
+	conf, output, err := parseFlags(programName, args)
+	if err != nil {
 		fmt.Println("output:\n", output)
-		os.Exit(1)
+		return exitConfig
 	}
 
 	// Let's validate the configuration.
-	if ok, msg := conf.Validate(); !ok {
-		log.Fatalln(msg)
+	if err := conf.Validate(); err != nil {
+		log.Println(err)
+		return exitConfig
 	}
 
-	// Let's connect to facebox and instantiate our fbox global variable.
-	fbox = facebox.New(conf.FaceboxUrl)
-
-	// Let's test the connection with facebox.
-	_, err = fbox.Info()
+	// Let's configure the logger.
+	closeLog, err := setUpLogger(conf)
 	if err != nil {
-		log.Fatalln(err)
+		log.Println(err)
+		return exitConfig
+	}
+	defer closeLog()
+
+	// Let's connect to facebox.
+	if err := connectFacebox(conf.FaceboxUrl); err != nil {
+		log.Printf("we couldn't reach facebox at %s; got error %s", conf.FaceboxUrl, err)
+		return exitUnreachable
+	}
+
+	// Let's expose the metrics of the run, if the user wants to scrape them.
+	if conf.MetricsAddr != "" {
+		stopMetrics, err := serveMetrics(conf.MetricsAddr)
+		if err != nil {
+			log.Println(err)
+			return exitConfig
+		}
+		defer stopMetrics()
 	}
 
 	// Let's run the application.
 	if err := run(conf); err != nil {
-		log.Fatalln(err)
+		log.Println(err)
+		return exitCode(err)
 	}
+	return exitOK
+}
+
+// connectFacebox connects to the facebox instance in the given url, instantiates our fbox
+// global variable and tests the connection.
+func connectFacebox(faceboxUrl string) error {
+	fbox = instrumentedRecognizer{facebox.New(faceboxUrl)}
+	_, err := fbox.Info()
+	return err
 }
 
 // run runs our main program logic with the given config options.
@@ -71,17 +173,14 @@ func run(c *config) error {
 	// Let's collect the people's pictures that we want to recognize.
 	err := collectPeoplePics(c)
 	if err != nil {
-		return err
+		return configError{err}
 	}
 
-	// We need to check if the client of the app wants to do multiple matches on each picture.
-	// If so, we need to check first if the passed names in config.People match the ones in
-	// config.PeopleCombined.
-	if c.MatchMultiple {
-		if success := c.CheckPeopleCombination(); !success {
-			return fmt.Errorf("there is a mismatch with the names of the people defined " +
-				"in peopledir and the flag combine")
-		}
+	// Let's make sure that the people's pictures are good enough to be taught to facebox.
+	reports, err := validateTeachingPics(c)
+	printTeachingSummary(os.Stdout, reports)
+	if err != nil {
+		return err
 	}
 
 	// Let's create the folders for the pictures of the people we want to filter out.
@@ -91,7 +190,7 @@ func run(c *config) error {
 	}
 
 	// Let's teach facebox about the people we want to recognize.
-	err = teachFacebox(c)
+	err = teachFacebox(c, reports)
 	if err != nil {
 		return err
 	}
@@ -99,78 +198,194 @@ func run(c *config) error {
 	done := make(chan struct{})
 	defer close(done)
 
-	paths, errc := walkFiles(done, c.PicsDir)
-	ch := make(chan result)
-	var wg sync.WaitGroup
-	const numDigesters = 20
-	wg.Add(numDigesters)
-	for i := 0; i < numDigesters; i++ {
-		go func() {
-			digester(c, done, paths, ch)
-			wg.Done()
+	// Let's open the output archive, if the pictures should be stored in one.
+	if c.OutputArchive != "" {
+		archive, err := newArchiveSink(c.resolve(c.OutputArchive))
+		if err != nil {
+			return fmt.Errorf("we couldn't create the output archive; got err %s", err)
+		}
+		c.Sink = archive
+	}
+
+	// Let's only check each content once, no matter how many copies of it there are.
+	if c.Dedupe {
+		c.Seen = newSeenContent()
+	}
+
+	// The gallery and the unknown faces open the pictures again once they are checked, so
+	// let's keep the pictures inside archives around instead of reading the archives again.
+	if c.GalleryPath != "" || c.Unknown {
+		extracted, err := newExtractedEntries()
+		if err != nil {
+			return err
+		}
+		_extracted = extracted
+		defer func() {
+			_extracted.close()
+			_extracted = nil
 		}()
 	}
 
-	go func() {
-		wg.Wait()
-		close(ch)
-	}()
+	// Let's recognize the people in each picture of picsdir, or in each picture of the
+	// result index if we only want to re-evaluate a previous run.
+	var ch <-chan result
+	var errc <-chan error
+	if c.Reevaluate {
+		ch, errc = reevaluatePictures(c, done)
+	} else {
+		ch, errc = recognizePictures(c, done)
+	}
 
 	reClassifier := make(map[string][]result)
 	const success = "success"
 	const fail = "fail"
+	const skipped = "skipped"
+	const duplicate = "duplicate"
+	var results []result
+	summary := newRunSummary(c)
 	for re := range ch {
-		if re.err == nil {
+		summary.add(re)
+		switch {
+		case re.skipped != "":
+			reClassifier[skipped] = append(reClassifier[skipped], re)
+			continue
+		case re.duplicateOf != "":
+			reClassifier[duplicate] = append(reClassifier[duplicate], re)
+		case re.err == nil:
 			reClassifier[success] = append(reClassifier[success], re)
-		} else {
+		default:
 			reClassifier[fail] = append(reClassifier[fail], re)
 		}
+		results = append(results, re)
+	}
+
+	if c.Sink != nil {
+		if err := c.Sink.close(); err != nil {
+			return fmt.Errorf("we couldn't write the output archive; got err %s", err)
+		}
+	}
+
+	if c.NearDuplicates != "" {
+		if err := handleNearDuplicates(c, results); err != nil {
+			return fmt.Errorf("we couldn't handle the near-duplicate pictures; got err %s", err)
+		}
 	}
 
 	for _, positiveResult := range reClassifier[success] {
-		_logger.Printf("Success to recognize people in file %s", positiveResult.path)
+		fields := positiveResult.logFields()
+		fields = append(fields, field("destinations", strings.Join(positiveResult.destinations, ",")))
+		if len(positiveResult.frames) > 0 {
+			fields = append(fields, field("matched_frames", formatFrames(positiveResult.frames)))
+		}
+		_logger.Info("Success to recognize people", fields...)
 	}
 
 	for _, failure := range reClassifier[fail] {
-		_logger.Printf("Failed to recognize people in file %s; got error %s", failure.path, failure.err)
+		fields := append(failure.logFields(), field("error_kind", errorKind(failure.err)), field("error", failure.err))
+		if errorKind(failure.err) == errorKindNoMatch {
+			_logger.Info("Failed to recognize people", fields...)
+			continue
+		}
+		_logger.Error("Failed to recognize people", fields...)
+	}
+
+	for _, skip := range reClassifier[skipped] {
+		_logger.Debug("Skipped file", append(skip.logFields(), field("reason", skip.skipped))...)
+	}
+
+	for _, dup := range reClassifier[duplicate] {
+		_logger.Info("Skipped duplicate file", append(dup.logFields(), field("duplicate_of", dup.duplicateOf))...)
+	}
+
+	printRunSummary(os.Stdout, summary)
+
+	if c.Unknown {
+		if err := saveUnknownFaces(c, results); err != nil {
+			return fmt.Errorf("we couldn't save the unknown faces; got err %s", err)
+		}
+	}
+
+	if c.GalleryPath != "" {
+		if err := writeGallery(c, results); err != nil {
+			return fmt.Errorf("we couldn't write the gallery; got err %s", err)
+		}
+	}
+
+	if c.IndexPath != "" {
+		if err := newResultIndex(results).save(c.IndexPath); err != nil {
+			return fmt.Errorf("we couldn't save the result index; got err %s", err)
+		}
 	}
 
 	if err := <-errc; err != nil {
 		return fmt.Errorf("we couldn't check all the pictures in picsdir; got err %s", err)
 	}
 
+	if summary.failed > c.MaxFailures {
+		return &tooManyFailuresError{failed: summary.failed, max: c.MaxFailures}
+	}
+
 	return nil
 }
 
+// recognizePictures starts the pipeline that walks through picsdir and recognizes the people
+// in each picture. The results of each picture are sent on the result channel and the result
+// of the walk on the error channel.
+func recognizePictures(c *config, done <-chan struct{}) (<-chan result, <-chan error) {
+	paths, errc := inputPaths(c, done)
+	ch := make(chan result)
+	var wg sync.WaitGroup
+	const numDigesters = 20
+	wg.Add(numDigesters)
+	for i := 0; i < numDigesters; i++ {
+		go func(worker int) {
+			digester(c, worker, done, paths, ch)
+			wg.Done()
+		}(i + 1)
+	}
+
+	go func() {
+		wg.Wait()
+		close(ch)
+	}()
+
+	return ch, errc
+}
+
 // collectPeoplePics walks through the people's dir and get the people's pictures that we want
 // to recognize, and stores the peoples' names and files' paths in config.People map. Where each
 // key of the map will be the name of a person and its value a slice with the paths of the pictures
-// of that person.
+// of that person. The pictures with a bad file name or that cannot be read, and a people's dir
+// without pictures, are reported all at once in a validationErrors.
 func collectPeoplePics(c *config) error {
+	c.People = make(PeopleToIdentify)
+	var problems validationErrors
 	err := filepath.Walk(c.PeopleDir, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
 
-		if info.Name() == c.PeopleDir {
+		if path == c.PeopleDir {
 			return nil
 		}
 
-		if info.IsDir() && info.Name() != c.PeopleDir {
+		if info.IsDir() {
 			return filepath.SkipDir
 		}
 
 		file, errFile := os.Open(path)
 		if errFile != nil {
-			return errFile
+			problems.add("PeopleDir", peopleDirFlag, "cannot open the picture %s; got error %s", path, errFile)
+			return nil
 		}
 		defer file.Close()
 
 		_, format, imageErr := image.DecodeConfig(file)
 		if imageErr != nil {
-			return imageErr
+			problems.add("PeopleDir", peopleDirFlag, "cannot read the picture %s; got error %s", path, imageErr)
+			return nil
 		}
-		if format != "jpeg" && format != "png" {
+		if !c.formatAllowed(format) {
 			return nil
 		}
 
@@ -178,7 +393,8 @@ func collectPeoplePics(c *config) error {
 		var name string
 
 		if idx == -1 || idx == 0 {
-			return fmt.Errorf("incorrect file name %s in path (%s)", info.Name(), path)
+			problems.add("PeopleDir", peopleDirFlag, "incorrect file name %s in path (%s); it should look like name_1.jpg", info.Name(), path)
+			return nil
 		}
 
 		name = info.Name()[:idx]
@@ -186,15 +402,48 @@ func collectPeoplePics(c *config) error {
 
 		return nil
 	})
+	if err != nil {
+		return err
+	}
 
-	return err
+	// The people taught through an imported state don't need pictures in peopledir.
+	imported, err := importedPeople(c)
+	if err != nil {
+		return err
+	}
+	for name := range imported {
+		if !c.People.exists(name) {
+			c.People[name] = nil
+		}
+	}
+
+	if len(c.People) == 0 && len(problems) == 0 {
+		problems.add("PeopleDir", peopleDirFlag, "directory %s has no pictures of people in the allowed formats", c.PeopleDir)
+	}
+	if len(problems) > 0 {
+		return problems
+	}
+	return nil
 }
 
 // createFoldersForPeople will create folders in the current dir where we are going to store
-// the pictures of the people we want to recognize. If config.MatchMultiple
+// the pictures of the people we want to recognize, unless they are stored in config.OutputArchive,
+// and the folder for the annotated pictures if config.Annotate is true. If config.MatchMultiple
 // option is true instead of creating multiple folders for each person that we are going to recognize,
 // createFoldersForPeople will create one folder with the name defined in config.PeopleCombinedDirName.
 func createFoldersForPeople(c *config) error {
+	if c.Annotate {
+		err := os.MkdirAll(c.resolve(c.ReviewDir), 0755)
+		if err != nil {
+			return err
+		}
+	}
+
+	// The pictures go into the output archive instead.
+	if c.OutputArchive != "" {
+		return nil
+	}
+
 	if c.MatchMultiple {
 		path := filepath.Join(c.WorkingDir, c.PeopleCombinedDirName)
 		err := os.MkdirAll(path, 0755)
@@ -214,131 +463,530 @@ func createFoldersForPeople(c *config) error {
 	return nil
 }
 
-// teachFacebox will teach the facebox instance about the people we want to recognize.
-// If the coolDownPeriodFlag is true, we will wait five seconds to give enough
-// time to facebox to assimilate the pictures.
-func teachFacebox(c *config) error {
-	for name, paths := range c.People {
-		for _, p := range paths {
-			fullPath := filepath.Join(c.WorkingDir, c.PeopleDir, p)
-			img, err := os.Open(fullPath)
-			if err != nil {
-				return err
-			}
-			filename := filepath.Base(p)
-			err = fbox.Teach(img, filename, name)
-			if err != nil {
-				return err
-			}
-			img.Close()
-		}
-	}
-
-	if c.CoolDownPeriod {
-		fmt.Println("There would be a cooldown period of 5 seconds, please wait...")
-		time.Sleep(time.Second * 5)
-	}
-
-	return nil
-}
-
 // result represents the result of trying to recognize people from a picture in a particular path.
 type result struct {
 	path string
 	err  error
+
+	// faces holds the faces facebox found in the picture.
+	faces []facebox.Face
+
+	// destinations holds the names of the folders where the picture was copied to.
+	destinations []string
+
+	// frame is the index of the frame the faces were found in. It's only set for
+	// pictures with several frames, see recognizeFrames.
+	frame int
+
+	// frames maps each destination to the index of the first frame that matched it.
+	frames map[string]int
+
+	// folders maps each destination whose copy was moved to a subfolder, e.g. by the group
+	// mode of config.NearDuplicates, to that subfolder, e.g. bill/similar_01.
+	folders map[string]string
+
+	// skipped holds the reason why the file wasn't checked at all, e.g. because it isn't
+	// a picture. Skipped files are neither successes nor failures.
+	skipped string
+
+	// duplicateOf holds the path of the picture with the same content that was checked
+	// instead of this one, if any.
+	duplicateOf string
+
+	// worker is the number of the digester that checked the picture, and duration how long
+	// it took to check it.
+	worker   int
+	duration time.Duration
 }
 
-// walkFiles starts a goroutine to walk the directory tree at root and send the
-// path of each regular file on the string channel. It send the result of the
-// walk on the error channel. If done is closed, walkFiles abandons its work.
-func walkFiles(done <-chan struct{}, root string) (<-chan string, <-chan error) {
-	paths := make(chan string)
+// folder returns the folder where the copy of the picture in the given destination is.
+func (re result) folder(dest string) string {
+	if f, ok := re.folders[dest]; ok {
+		return f
+	}
+	return dest
+}
+
+// logFields returns the fields every log entry about the result has.
+func (re result) logFields() []logField {
+	return []logField{
+		field("path", re.path),
+		field("worker", re.worker),
+		field("duration", re.duration),
+		field("faces", len(re.faces)),
+	}
+}
+
+// walkFiles starts a goroutine to walk the directory tree at root and send each
+// regular file on the item channel, except for the files and directories the given
+// filter skips. The files inside the archives of the tree are sent too, as if the
+// archives were directories. It send the result of the walk on the error channel.
+// If done is closed, walkFiles abandons its work.
+func walkFiles(conf *config, done <-chan struct{}, root string, filter *walkFilter) (<-chan item, <-chan error) {
+	items := make(chan item)
 	errc := make(chan error, 1)
+	send := func(it item) error {
+		select {
+		case items <- it:
+			return nil
+		case <-done:
+			return errors.New("walk canceled")
+		}
+	}
 	go func() {
-		defer close(paths)
+		defer close(items)
 		errc <- filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
 			if err != nil {
 				return err
 			}
-			if !info.Mode().IsRegular() {
+			skip, err := filter.skip(path, info)
+			if err != nil {
+				return err
+			}
+			if skip && info.IsDir() {
+				return filepath.SkipDir
+			}
+			if skip || !info.Mode().IsRegular() {
 				return nil
 			}
-
-			select {
-			case paths <- path:
-			case <-done:
-				return errors.New("walk canceled")
+			if isArchive(info.Name()) {
+				if err := sendArchive(conf, path, filter, send); err != nil {
+					return fmt.Errorf("couldn't read the archive %s; got error %s", path, err)
+				}
+				return nil
 			}
-			return nil
+			return send(item{path: path})
 		})
 	}()
-	return paths, errc
+	return items, errc
 }
 
-// digester reads path names from paths and sends digests of the corresponding
-// files on c until either paths or done is closed.
-func digester(conf *config, done <-chan struct{}, paths <-chan string, c chan<- result) {
-	for path := range paths {
-		err := recognizeAndCopy(conf, path)
+// digester reads the files to check from items and sends digests of the corresponding
+// files on c until either items or done is closed. The given worker number identifies the
+// digester in the log.
+func digester(conf *config, worker int, done <-chan struct{}, items <-chan item, c chan<- result) {
+	for it := range items {
+		// The files inside archives are opened from memory while they are checked.
+		if it.data != nil {
+			pendingEntries.Store(filepath.Clean(conf.resolve(it.path)), it.data)
+		}
+		_metrics.workersInFlight.add("", 1)
+		start := time.Now()
+		var re result
+		if it.skipped != "" || it.err != nil {
+			// The files inside archives that weren't extracted were settled while walking.
+			re = result{path: it.path, skipped: it.skipped, err: it.err}
+		} else {
+			re = recognizeAndCopy(conf, it.path)
+		}
+		re.worker, re.duration = worker, time.Since(start)
+		_metrics.workersInFlight.add("", -1)
+		_metrics.recordResult(re)
+		if it.data != nil {
+			if _extracted != nil && re.skipped == "" && re.duplicateOf == "" {
+				if err := _extracted.store(conf.resolve(it.path), it.data); err != nil {
+					_logger.Warn("Couldn't keep the picture extracted from its archive", field("path", it.path), field("error", err))
+				}
+			}
+			pendingEntries.Delete(filepath.Clean(conf.resolve(it.path)))
+		}
 		select {
-		case c <- result{path, err}:
+		case c <- re:
 		case <-done:
 			return
 		}
 	}
 }
 
+// Errors returned by classify when the faces in a picture don't match the people we want
+// to recognize.
+var (
+	errNoMatch      = errors.New("there is no match")
+	errNoRigidMatch = errors.New("there is no rigid match")
+)
+
+// recognizerError wraps the errors facebox returns when it checks a picture.
+type recognizerError struct {
+	err error
+}
+
+func (e recognizerError) Error() string {
+	return e.err.Error()
+}
+
+func (e recognizerError) Unwrap() error {
+	return e.err
+}
+
+// The kinds of errors a picture can fail with, see errorKind.
+const (
+	errorKindNoMatch    = "no_match"
+	errorKindRecognizer = "recognizer"
+	errorKindDecode     = "decode"
+	errorKindIO         = "io"
+	errorKindOther      = "other"
+)
+
+// errorKind returns the kind of the given error of a picture, so failures can be told apart
+// in the log: the picture didn't match anyone, facebox failed, the picture couldn't be decoded,
+// or the file couldn't be read or written.
+func errorKind(err error) string {
+	var idxErr indexedError
+	var recErr recognizerError
+	var pathErr *os.PathError
+	var jpegErr jpeg.FormatError
+	var pngErr png.FormatError
+	switch {
+	case errors.As(err, &idxErr):
+		return idxErr.kind
+	case errors.Is(err, errNoMatch), errors.Is(err, errNoRigidMatch):
+		return errorKindNoMatch
+	case errors.As(err, &recErr):
+		return errorKindRecognizer
+	case errors.Is(err, image.ErrFormat), errors.Is(err, io.ErrUnexpectedEOF), errors.As(err, &jpegErr), errors.As(err, &pngErr):
+		return errorKindDecode
+	case errors.As(err, &pathErr):
+		return errorKindIO
+	}
+	return errorKindOther
+}
+
 // recognizeAndCopy tries to recognize people in a picture located in the given path.
 // If it succeeds to do so recognizeAndCopy will copy the picture in the corresponding
 // path for all recognized pictures.
-// TODO: It might be a good idea to factor out the logic when conf.MatchMultiple is True or False.
-// TODO: I need to put more thought on this, but for now it works :)
-func recognizeAndCopy(conf *config, path string) error {
-	fullPath := filepath.Join(conf.WorkingDir, path)
-	file, err := os.Open(fullPath)
+func recognizeAndCopy(conf *config, path string) (re result) {
+	re.path = path
+	file, err := openFile(conf.resolve(path))
 	if err != nil {
-		return err
+		re.err = err
+		return
 	}
 	defer file.Close()
-	_, format, err := image.DecodeConfig(file)
+
+	// Let's not bother facebox with files that aren't pictures we want to check.
+	re.skipped, err = skipReason(conf, path, file)
 	if err != nil {
-		return err
+		re.err = err
+		return
+	}
+	if re.skipped != "" {
+		return
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		re.err = err
+		return
+	}
+
+	// Let's only check one of the copies of the same picture.
+	if conf.Seen != nil {
+		re.duplicateOf, err = conf.Seen.claim(path, file)
+		if err != nil || re.duplicateOf != "" {
+			re.err = err
+			return
+		}
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			re.err = err
+			return
+		}
+	}
+
+	cfg, format, err := image.DecodeConfig(file)
+	if err != nil {
+		re.err = err
+		return
 	}
 
-	if format != "jpeg" && format != "png" {
-		return fmt.Errorf("file is not of type jpeg nor png")
+	if !conf.formatAllowed(format) {
+		re.err = fmt.Errorf("file of type %s is not one of the allowed formats (%s)", format, strings.Join(conf.AllowedFormats, ", "))
+		return
 	}
 
 	// We need to rewind the file so it can be read in other functions.
 	_, err = file.Seek(0, io.SeekStart)
 	if err != nil {
-		return err
+		re.err = err
+		return
+	}
+
+	if conf.FrameStride > 0 && hasFrames(format) {
+		return recognizeFrames(conf, path, file, format)
+	}
+
+	// Let's get the image we want facebox to see.
+	img, toStored, err := prepareForRecognition(conf, file, cfg, format)
+	if err != nil {
+		re.err = err
+		return
 	}
 
 	// Let's get the faces in the photo.
-	faces, err := fbox.Check(file)
+	re.faces, err = checkFaces(conf, img)
 	if err != nil {
-		return err
+		re.err = err
+		return
+	}
+	for i := range re.faces {
+		re.faces[i].Rect = toStored(re.faces[i].Rect)
 	}
 
-	// We need to rewind the file so it can be read in other functions.
-	_, err = file.Seek(0, io.SeekStart)
+	re.destinations, re.err = classifyAndCopy(conf, path, 0, re.faces)
+	return
+}
+
+// recognizeFrames recognizes the people in every config.FrameStride-th frame of the picture
+// in the given file. The picture matches a person if any of the sampled frames does, in which
+// case it's copied just once to the folder of that person. The result keeps the first frame
+// that matched each destination, and the faces of the first frame that matched anyone, or
+// of the first frame if none did. Annotations and face crops are made for each sampled frame
+// and named after the frame, e.g. x_frame3.jpg and x_frame3_face1.jpg.
+func recognizeFrames(conf *config, path string, file io.Reader, format string) (re result) {
+	re.path = path
+	frames, err := decodeFrames(file, format, conf.FrameStride)
 	if err != nil {
-		return err
+		re.err = err
+		return
 	}
 
-	match := false
-	rigidFail := false
+	re.frames = make(map[string]int)
+	var matchErr error
+	for i, f := range frames {
+		img, toFrame, err := encodeFrame(f.img, conf.MaxDimension)
+		if err != nil {
+			re.err = err
+			return
+		}
+		faces, err := checkFaces(conf, img)
+		if err != nil {
+			re.err = fmt.Errorf("we couldn't check the frame %d; got error %w", f.index, err)
+			return
+		}
+		for j := range faces {
+			faces[j].Rect = toFrame(faces[j].Rect)
+		}
+		if i == 0 {
+			re.faces, re.frame = faces, f.index
+		}
+
+		pic := &picture{img: f.img, orientation: 1}
+		if conf.Annotate && len(faces) > 0 {
+			if err := annotatePicture(conf, pic, annotationName(path, f.index), faces); err != nil {
+				re.err = fmt.Errorf("we couldn't annotate the frame %d; got error %s", f.index, err)
+				return
+			}
+		}
+
+		destinations, err := classify(conf, faces)
+		if err == errNoMatch || err == errNoRigidMatch {
+			matchErr = err
+			continue
+		} else if err != nil {
+			re.err = err
+			return
+		}
+		if len(re.destinations) == 0 {
+			re.faces, re.frame = faces, f.index
+		}
+		for _, dest := range destinations {
+			if _, ok := re.frames[dest]; !ok {
+				re.frames[dest] = f.index
+				re.destinations = append(re.destinations, dest)
+			}
+		}
+		if conf.Crop {
+			if err := copyFaceCrops(conf, pic, frameName(path, f.index), faces, destinations); err != nil {
+				re.err = err
+				return
+			}
+		}
+	}
 
+	if len(re.destinations) == 0 {
+		if matchErr == nil {
+			matchErr = errNoMatch
+		}
+		re.err = fmt.Errorf("%w in any of the %d sampled frames with a confidence %.2f", matchErr, len(frames), conf.Confidence)
+		return
+	}
+	if !conf.CropOnly {
+		for _, dest := range re.destinations {
+			if err := copyPicture(conf, path, dest); err != nil {
+				re.err = err
+				return
+			}
+		}
+	}
+	return
+}
+
+// prepareForRecognition returns the image of the given picture file that should be sent to
+// facebox, and a function that converts the face rects facebox finds in that image to the
+// coordinates of the stored pixels of the picture, which is what the rest of coalescer uses.
+// Pictures in formats facebox doesn't accept are sent as JPEG. If config.NormalizeOrientation
+// is true, pictures with an EXIF orientation are sent upright, and if config.MaxDimension is set,
+// large pictures are sent downscaled.
+func prepareForRecognition(conf *config, file io.ReadSeeker, cfg image.Config, format string) (io.Reader, func(facebox.Rect) facebox.Rect, error) {
+	identity := func(r facebox.Rect) facebox.Rect { return r }
+
+	orientation := 1
+	if conf.NormalizeOrientation && format == "jpeg" {
+		orientation = readOrientation(file)
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			return nil, nil, err
+		}
+	}
+	downscale := conf.MaxDimension > 0 && (cfg.Width > conf.MaxDimension || cfg.Height > conf.MaxDimension)
+	if orientation == 1 && !downscale && recognizerAccepts(format) {
+		return file, identity, nil
+	}
+
+	img, _, err := image.Decode(file)
+	if err != nil {
+		return nil, nil, err
+	}
+	upright := applyOrientation(img, orientation)
+	scaled := upright
+	if downscale {
+		scaled = resizeToFit(upright, conf.MaxDimension)
+	}
+	var buf bytes.Buffer
+	if err := encodeImage(&buf, scaled, "jpeg"); err != nil {
+		return nil, nil, err
+	}
+
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	sx := float64(upright.Bounds().Dx()) / float64(scaled.Bounds().Dx())
+	sy := float64(upright.Bounds().Dy()) / float64(scaled.Bounds().Dy())
+	return &buf, func(r facebox.Rect) facebox.Rect {
+		r = facebox.Rect{
+			Top:    int(float64(r.Top) * sy),
+			Left:   int(float64(r.Left) * sx),
+			Width:  int(float64(r.Width) * sx),
+			Height: int(float64(r.Height) * sy),
+		}
+		return unorientRect(r, w, h, orientation)
+	}, nil
+}
+
+// checkFaces returns the faces facebox finds in the given image. If we need to keep
+// a result index or to cluster unknown faces, the faces will carry their faceprints too.
+func checkFaces(conf *config, image io.Reader) ([]facebox.Face, error) {
+	if conf.IndexPath == "" && !conf.Unknown {
+		faces, err := fbox.Check(image)
+		if err != nil {
+			return nil, recognizerError{err}
+		}
+		return faces, nil
+	}
+	var buf bytes.Buffer
+	enc := base64.NewEncoder(base64.StdEncoding, &buf)
+	if _, err := io.Copy(enc, image); err != nil {
+		return nil, err
+	}
+	if err := enc.Close(); err != nil {
+		return nil, err
+	}
+	faces, err := fbox.CheckBase64WithFaceprint(buf.String())
+	if err != nil {
+		return nil, recognizerError{err}
+	}
+	return faces, nil
+}
+
+// classifyAndCopy classifies the given faces of the picture located in the given path
+// and copies the picture to the folders of the people recognized in it. The faces were
+// found in the frame with the given index, which is 0 for pictures with a single frame.
+func classifyAndCopy(conf *config, path string, frame int, faces []facebox.Face) ([]string, error) {
+	if conf.Annotate && len(faces) > 0 {
+		pic, err := loadPictureFrame(conf.resolve(path), frame)
+		if err == nil {
+			err = annotatePicture(conf, pic, annotationName(path, frame), faces)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("we couldn't annotate the picture; got error %s", err)
+		}
+	}
+
+	destinations, err := classify(conf, faces)
+	if err == errNoMatch || err == errNoRigidMatch {
+		return nil, fmt.Errorf("%w with a confidence %.2f", err, conf.Confidence)
+	} else if err != nil {
+		return nil, err
+	}
+
+	if !conf.CropOnly {
+		for _, dest := range destinations {
+			if err := copyPicture(conf, path, dest); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if conf.Crop {
+		pic, err := loadPictureFrame(conf.resolve(path), frame)
+		if err != nil {
+			return nil, err
+		}
+		if err := copyFaceCrops(conf, pic, frameName(path, frame), faces, destinations); err != nil {
+			return nil, err
+		}
+	}
+	return destinations, nil
+}
+
+// recognized checks whether the given face is a person we want to recognize with enough confidence.
+func recognized(conf *config, face facebox.Face) bool {
+	if !face.Matched || face.Confidence < conf.Confidence {
+		return false
+	}
+	if conf.MatchMultiple {
+		return conf.PeopleCombined.exists(face.Name)
+	}
+	return conf.People.exists(face.Name)
+}
+
+// copyFaceCrops crops the recognized faces of the given picture and stores them in the given
+// folders. The crops are named after the given stem and the position of each face in the
+// picture, e.g. the crops of the picture x.jpg are named x_face1.jpg, x_face2.jpg, and so on.
+func copyFaceCrops(conf *config, pic *picture, stem string, faces []facebox.Face, folders []string) error {
+	ext := ".jpg"
+	if conf.CropFormat == "png" {
+		ext = ".png"
+	}
+
+	for _, folder := range folders {
+		for i, face := range faces {
+			// In the folder of a single person we only want the faces of that person.
+			if !recognized(conf, face) || (!conf.MatchMultiple && face.Name != folder) {
+				continue
+			}
+			crop := pic.cropFace(face.Rect, conf.CropPadding)
+			if crop.Bounds().Empty() {
+				continue
+			}
+			crop = resizeToFit(crop, conf.CropSize)
+			name := fmt.Sprintf("%s_face%d%s", stem, i+1, ext)
+			var buf bytes.Buffer
+			if err := encodeImage(&buf, crop, conf.CropFormat); err != nil {
+				return err
+			}
+			if err := conf.output().put(folder, name, &buf); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// classify returns the names of the folders where a picture with the given faces
+// should be copied to. If config.MatchMultiple is true the picture should contain all
+// the people in config.PeopleCombined, otherwise any of the people in config.People.
+// If config.Rigid is true the picture should contain exclusively those people.
+func classify(conf *config, faces []facebox.Face) ([]string, error) {
 	if conf.MatchMultiple {
 		matchesCount := make([]bool, 0)
 		for _, name := range conf.PeopleCombined {
 			itMatches := false
 			for _, face := range faces {
-				if face.Matched && face.Name == name {
-					if face.Confidence < conf.Confidence {
-						continue
-					}
+				if recognized(conf, face) && face.Name == name {
 					itMatches = true
 					break
 				}
@@ -346,62 +994,40 @@ func recognizeAndCopy(conf *config, path string) error {
 			matchesCount = append(matchesCount, itMatches)
 		}
 		if conf.Rigid && len(faces) != len(conf.PeopleCombined) {
-			rigidFail = true
-			goto RigidFail
+			return nil, errNoRigidMatch
 		}
-		if allTrue(matchesCount) {
-			nfPath := filepath.Join(conf.WorkingDir, conf.PeopleCombinedDirName, filepath.Base(path))
-			nf, err := os.Create(nfPath)
-			if err != nil {
-				return err
-			}
-			_, err = io.Copy(nf, file)
-			if err != nil {
-				nf.Close()
-				return err
-			}
-			nf.Close()
-			match = true
+		if !allTrue(matchesCount) {
+			return nil, errNoMatch
 		}
-	} else {
-		if conf.Rigid && len(faces) > 1 {
-			rigidFail = true
-			goto RigidFail
-		}
-		for _, face := range faces {
-			if face.Matched && conf.People.exists(face.Name) {
-				if face.Confidence < conf.Confidence {
-					continue
-				}
-				nfPath := filepath.Join(conf.WorkingDir, face.Name, filepath.Base(path))
-				nf, err := os.Create(nfPath)
-				if err != nil {
-					return err
-				}
-				_, err = io.Copy(nf, file)
-				if err != nil {
-					nf.Close()
-					return err
-				}
-				nf.Close()
-				// We need to rewind the file so it can be read in the next iteration.
-				_, err = file.Seek(0, io.SeekStart)
-				if err != nil {
-					return fmt.Errorf("we couldn't rewind the file in the loop; got error %s", err)
-				}
-				match = true
+		return []string{conf.PeopleCombinedDirName}, nil
+	}
+
+	if conf.Rigid && len(faces) > 1 {
+		return nil, errNoRigidMatch
+	}
+	var destinations []string
+	for _, face := range faces {
+		if recognized(conf, face) {
+			if !PeopleCombination(destinations).exists(face.Name) {
+				destinations = append(destinations, face.Name)
 			}
 		}
 	}
-	if !match {
-		return fmt.Errorf("there is no match with a confidence %.2f", conf.Confidence)
-	}
-RigidFail:
-	if rigidFail {
-		return fmt.Errorf("there is no rigid match with a confidence %.2f", conf.Confidence)
+	if len(destinations) == 0 {
+		return nil, errNoMatch
 	}
+	return destinations, nil
+}
 
-	return nil
+// copyPicture copies the picture located in the given path to the folder with the given name
+// of the output of coalescer. See config.output.
+func copyPicture(conf *config, path, folder string) error {
+	file, err := openFile(conf.resolve(path))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return conf.output().put(folder, filepath.Base(path), file)
 }
 
 // allTrue checks whether all booleans in the given slice are True or not.
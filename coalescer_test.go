@@ -2,19 +2,22 @@ package main
 
 import (
 	"crypto/sha1"
+	"encoding/base64"
 	"fmt"
 	"github.com/machinebox/sdk-go/boxutil"
 	"github.com/machinebox/sdk-go/facebox"
+	"image"
 	"io"
+	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 )
 
 func TestMain(m *testing.M) {
-	testingLogger := log.New(os.Stdout, "testingLogger", log.Lshortfile)
-	_logger = testingLogger
+	_logger = newLogger(os.Stdout, levelDebug, logFormatText)
 	code := m.Run()
 	os.Exit(code)
 }
@@ -22,6 +25,11 @@ func TestMain(m *testing.M) {
 var testFilesMapSha = map[string]string{
 	"598fe17e22744b1a4ec6c053677a8e686c71beac": "bill_and_steve.jpg",
 	"b13cba3f6478673bee294c3e99f6e0196616e1d7": "mark_and_bill.jpg",
+	"7069fe1154a9f399bc506850d7bc46553ef39cac": "bill_gates_1.jpg",
+	"6add07fc7dc71a247ac544f30d2d2fe274324815": "bill_gates_2.jpg",
+	"34c799fa76d966f98e46cb556ab25e2948472635": "bill_gates_3.png",
+	"4613b4a4e5d43f5e628ab243086865f2ff491bb0": "mark_zuckerberg_1.jpg",
+	"a3522c2cb4fcf031b6b2cf78798251822eb1cc2e": "mark_zuckerberg_2.jpg",
 }
 
 type mockRecognizer struct {
@@ -40,6 +48,51 @@ func (c *mockRecognizer) Teach(image io.Reader, id string, name string) error {
 	return nil
 }
 
+func (c *mockRecognizer) Remove(id string) error {
+	return nil
+}
+
+func (c *mockRecognizer) OpenState() (io.ReadCloser, error) {
+	return ioutil.NopCloser(strings.NewReader("state")), nil
+}
+
+func (c *mockRecognizer) PostState(r io.Reader) error {
+	return nil
+}
+
+func (c *mockRecognizer) CheckBase64WithFaceprint(data string) ([]facebox.Face, error) {
+	faces, err := c.Check(base64.NewDecoder(base64.StdEncoding, strings.NewReader(data)))
+	if err != nil {
+		return nil, err
+	}
+	// The mock faceprint of each face is just the name of the person.
+	for i := range faces {
+		faces[i].Faceprint = "faceprint:" + faces[i].Name
+	}
+	return faces, nil
+}
+
+func (c *mockRecognizer) CheckFaceprints(faceprints []string) ([]facebox.Face, error) {
+	faces := make([]facebox.Face, 0, len(faceprints))
+	for _, fp := range faceprints {
+		name := strings.TrimPrefix(fp, "faceprint:")
+		faces = append(faces, facebox.Face{Name: name, Matched: name != "", Confidence: 70})
+	}
+	return faces, nil
+}
+
+func (c *mockRecognizer) CompareFaceprints(target string, faceprintCandidates []string) ([]float64, error) {
+	confidences := make([]float64, 0, len(faceprintCandidates))
+	for _, fp := range faceprintCandidates {
+		if fp == target {
+			confidences = append(confidences, 0.9)
+		} else {
+			confidences = append(confidences, 0.1)
+		}
+	}
+	return confidences, nil
+}
+
 func (c *mockRecognizer) Check(image io.Reader) ([]facebox.Face, error) {
 	hash := sha1.New()
 
@@ -55,6 +108,22 @@ func (c *mockRecognizer) Check(image io.Reader) ([]facebox.Face, error) {
 		return nil, fmt.Errorf("an unknown image was given to mockCombination while testing")
 	}
 
+	// The pictures from people_dir contain only one face each, which facebox recognizes
+	// as the person in the filename.
+	if _, err := os.Stat(filepath.Join(testPeopleDir, pic)); err == nil {
+		faces := []facebox.Face{
+			{
+				Rect:       facebox.Rect{},
+				ID:         pic,
+				Name:       pic[:strings.Index(pic, "_")],
+				Matched:    true,
+				Confidence: 90,
+				Faceprint:  "",
+			},
+		}
+		return faces, nil
+	}
+
 	// In this image facebox should recognize 1 face.
 	if pic == "bill_and_steve.jpg" {
 		faces := []facebox.Face{
@@ -104,8 +173,8 @@ func Test_run_normal_usage_without_combination(t *testing.T) {
 		t.Fatalf("got error (%s) while using parseFlags. Output was: %s", err, output)
 	}
 
-	if ok, msg := conf.Validate(); !ok {
-		t.Fatalf("conf.Validate() should be valid got message: %s", msg)
+	if err := conf.Validate(); err != nil {
+		t.Fatalf("conf.Validate() should be valid got error: %s", err)
 	}
 
 	// Let's clean the directory after testing.
@@ -118,6 +187,10 @@ func Test_run_normal_usage_without_combination(t *testing.T) {
 		if err != nil {
 			log.Println(err)
 		}
+		err = os.RemoveAll(conf.ManifestPath)
+		if err != nil {
+			log.Println(err)
+		}
 	}()
 
 	originalFacebox := fbox
@@ -171,8 +244,8 @@ func Test_run_usage_with_combination(t *testing.T) {
 		t.Fatalf("got error (%s) while using parseFlags. Output was: %s", err, output)
 	}
 
-	if ok, msg := conf.Validate(); !ok {
-		t.Fatalf("conf.Validate() should be valid got message: %s", msg)
+	if err := conf.Validate(); err != nil {
+		t.Fatalf("conf.Validate() should be valid got error: %s", err)
 	}
 
 	// Let's clean the directory after testing.
@@ -181,6 +254,10 @@ func Test_run_usage_with_combination(t *testing.T) {
 		if err != nil {
 			log.Println(err)
 		}
+		err = os.RemoveAll(conf.ManifestPath)
+		if err != nil {
+			log.Println(err)
+		}
 	}(conf.PeopleCombinedDirName)
 
 	originalFacebox := fbox
@@ -219,3 +296,49 @@ func Test_run_usage_with_combination(t *testing.T) {
 		}
 	}
 }
+
+func Test_prepareForRecognition_max_dimension(t *testing.T) {
+	c, err := newConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.MaxDimension = 300
+
+	f, err := os.Open("pics_dir/mark_and_bill.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	r, toStored, err := prepareForRecognition(c, f, image.Config{Width: 1200, Height: 800}, "jpeg")
+	if err != nil {
+		t.Fatalf("prepareForRecognition shouldn't fail; got error %s", err)
+	}
+	cfg, _, err := image.DecodeConfig(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Width != 300 || cfg.Height != 200 {
+		t.Errorf("expected a 300x200 image; got %dx%d", cfg.Width, cfg.Height)
+	}
+
+	// The face rects should be scaled back to the coordinates of the original picture.
+	got := toStored(facebox.Rect{Top: 25, Left: 150, Width: 50, Height: 50})
+	want := facebox.Rect{Top: 100, Left: 600, Width: 200, Height: 200}
+	if got != want {
+		t.Errorf("expected rect %v; got %v", want, got)
+	}
+
+	// Pictures that are already small enough should be sent untouched.
+	c.MaxDimension = 2000
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	r, _, err = prepareForRecognition(c, f, image.Config{Width: 1200, Height: 800}, "jpeg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r != io.Reader(f) {
+		t.Errorf("expected the original picture to be sent to facebox")
+	}
+}
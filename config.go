@@ -6,19 +6,55 @@ import (
 	"fmt"
 	"net/url"
 	"os"
+	"path/filepath"
 	"strings"
+	"time"
 )
 
 // Constant variables that represent the names of the flags that we are going to
 // use in the config struct and throughout the entire program.
 const (
-	peopleDirFlag      = "peopledir"
-	picsDirFlag        = "picsdir"
-	faceboxUrlFlag     = "faceboxurl"
-	coolDownPeriodFlag = "cooldown"
-	confidenceFlag     = "confidence"
-	combineFlag        = "combine"
-	rigidFlag          = "rigid"
+	peopleDirFlag            = "peopledir"
+	picsDirFlag              = "picsdir"
+	faceboxUrlFlag           = "faceboxurl"
+	coolDownPeriodFlag       = "cooldown"
+	coolDownTimeoutFlag      = "cooldown-timeout"
+	confidenceFlag           = "confidence"
+	combineFlag              = "combine"
+	rigidFlag                = "rigid"
+	reteachFlag              = "reteach"
+	manifestFlag             = "manifest"
+	indexFlag                = "index"
+	reevaluateFlag           = "reevaluate"
+	unknownFlag              = "unknown"
+	unknownDirFlag           = "unknown-dir"
+	unknownSimilarityFlag    = "unknown-similarity"
+	cropFlag                 = "crop"
+	cropOnlyFlag             = "crop-only"
+	cropPaddingFlag          = "crop-padding"
+	cropSizeFlag             = "crop-size"
+	cropFormatFlag           = "crop-format"
+	annotateFlag             = "annotate"
+	reviewDirFlag            = "review-dir"
+	galleryFlag              = "gallery"
+	normalizeOrientationFlag = "normalize-orientation"
+	maxDimensionFlag         = "max-dimension"
+	formatsFlag              = "formats"
+	frameStrideFlag          = "frame-stride"
+	includeFlag              = "include"
+	excludeFlag              = "exclude"
+	maxDepthFlag             = "max-depth"
+	skipHiddenFlag           = "skip-hidden"
+	filesFromFlag            = "files-from"
+	outputArchiveFlag        = "output-archive"
+	dedupeFlag               = "dedupe"
+	nearDuplicatesFlag       = "near-duplicates"
+	nearDuplicateDistFlag    = "near-duplicate-distance"
+	logFileFlag              = "log-file"
+	logLevelFlag             = "log-level"
+	logFormatFlag            = "log-format"
+	metricsAddrFlag          = "metrics-addr"
+	maxFailuresFlag          = "max-failures"
 )
 
 type PeopleToIdentify map[string][]string
@@ -41,20 +77,57 @@ func (pc PeopleCombination) exists(name string) bool {
 
 type config struct {
 	// fields that represent the flags used by this program.
-	PeopleDir      string
-	PicsDir        string
-	CoolDownPeriod bool
-	FaceboxUrl     string
-	WorkingDir     string
-	Combine        string
-	Confidence     float64
-	Rigid          bool
+	PeopleDir             string
+	PicsDirs              stringList
+	CoolDownPeriod        bool
+	CoolDownTimeout       time.Duration
+	FaceboxUrl            string
+	WorkingDir            string
+	Combine               string
+	Confidence            float64
+	Rigid                 bool
+	Reteach               bool
+	ManifestPath          string
+	IndexPath             string
+	Reevaluate            bool
+	Unknown               bool
+	UnknownDir            string
+	UnknownSimilarity     float64
+	Crop                  bool
+	CropOnly              bool
+	CropPadding           float64
+	CropSize              int
+	CropFormat            string
+	Annotate              bool
+	ReviewDir             string
+	GalleryPath           string
+	NormalizeOrientation  bool
+	MaxDimension          int
+	Formats               string
+	FrameStride           int
+	Include               stringList
+	Exclude               stringList
+	MaxDepth              int
+	SkipHidden            bool
+	FilesFrom             string
+	OutputArchive         string
+	Dedupe                bool
+	NearDuplicates        string
+	NearDuplicateDistance int
+	LogFile               string
+	LogLevel              string
+	LogFormat             string
+	MetricsAddr           string
+	MaxFailures           int
 
 	// custom fields.
 	People                PeopleToIdentify
 	PeopleCombined        PeopleCombination
 	PeopleCombinedDirName string
 	MatchMultiple         bool
+	AllowedFormats        []string
+	Sink                  sink
+	Seen                  *seenContent
 }
 
 // newConfig initializes a ready-to-use config struct.
@@ -64,8 +137,11 @@ func newConfig() (*config, error) {
 		return nil, err
 	}
 	c := &config{
-		People:     make(PeopleToIdentify),
-		WorkingDir: wdir,
+		People:         make(PeopleToIdentify),
+		WorkingDir:     wdir,
+		AllowedFormats: []string{"jpeg", "png"},
+		LogLevel:       levelInfo.String(),
+		LogFormat:      logFormatText,
 	}
 	return c, nil
 }
@@ -81,6 +157,21 @@ func (c *config) Transform() {
 		c.Confidence = c.Confidence / 100
 	}
 
+	// The same goes for the similarity between unknown faces.
+	if c.UnknownSimilarity < 1 || c.UnknownSimilarity > 99 {
+		c.UnknownSimilarity = 60.0 / 100
+	} else {
+		c.UnknownSimilarity = c.UnknownSimilarity / 100
+	}
+
+	// The padding of the face crops is a percentage of the size of each face.
+	c.CropPadding = c.CropPadding / 100
+
+	// If the user only wants the face crops we need to crop the faces in the first place.
+	if c.CropOnly {
+		c.Crop = true
+	}
+
 	// Let's get the names of the people the user wants to combine when checking faces in each picture.
 	c.PeopleCombined = strings.Split(c.Combine, ",")
 
@@ -99,58 +190,230 @@ func (c *config) Transform() {
 	}
 }
 
-// Validate validates the config fields.
-func (c *config) Validate() (ok bool, msg string) {
-	ok = true
-	msg += "\n"
+// validationError represents a problem with the value of a config field.
+type validationError struct {
+	Field  string
+	Flag   string
+	Reason string
+}
+
+func (e validationError) Error() string {
+	return fmt.Sprintf("-%s: %s", e.Flag, e.Reason)
+}
+
+// validationErrors represents all the problems found in a config, see config.Validate.
+type validationErrors []validationError
+
+// add adds a problem with the given field and flag. The reason is formatted with the given
+// arguments like fmt.Sprintf does.
+func (errs *validationErrors) add(field, flag, reason string, args ...interface{}) {
+	*errs = append(*errs, validationError{Field: field, Flag: flag, Reason: fmt.Sprintf(reason, args...)})
+}
+
+func (errs validationErrors) Error() string {
+	var b strings.Builder
+	b.WriteString("the configuration is invalid:\n")
+	for _, e := range errs {
+		fmt.Fprintf(&b, "  %s\n", e)
+	}
+	b.WriteString("For more information about the flags of this program, please run ./coalescer -h")
+	return b.String()
+}
+
+// Validate validates the config fields and the pictures in config.PeopleDir, which it collects
+// in config.People. It returns a validationErrors with every problem found, or nil.
+func (c *config) Validate() error {
+	var errs validationErrors
 
 	// Let's transform any default value or behaviour for our custom fields in config.
 	c.Transform()
 
 	if c.PeopleDir == "" {
-		ok = false
-		msg += fmt.Sprintf("%s flag is not defined.\n", peopleDirFlag)
-	}
-	if c.PicsDir == "" {
-		ok = false
-		msg += fmt.Sprintf("%s flag is not defined.\n", picsDirFlag)
-	}
-	if c.PeopleDir == c.PicsDir && c.PeopleDir != "" && c.PicsDir != "" {
-		ok = false
-		msg += fmt.Sprintf("the %s and %s flags cannot point to the same directory.\n", peopleDirFlag, picsDirFlag)
-	}
-	if info, err := os.Stat(c.PeopleDir); os.IsNotExist(err) {
-		ok = false
-		msg += fmt.Sprintf("directory %s specified by the flag %s does not exist.\n", c.PeopleDir, peopleDirFlag)
-	} else if !info.IsDir() {
-		ok = false
-		msg += fmt.Sprintf("directory %s specified by the flag %s is not a directory.\n", c.PeopleDir, peopleDirFlag)
-	}
-	if info, err := os.Stat(c.PicsDir); os.IsNotExist(err) {
-		ok = false
-		msg += fmt.Sprintf("directory %s specified by the flag %s does not exist.\n", c.PicsDir, picsDirFlag)
-	} else if !info.IsDir() {
-		ok = false
-		msg += fmt.Sprintf("directory %s specified by the flag %s is not a directory.\n", c.PicsDir, picsDirFlag)
-	}
-	if u, err := url.Parse(c.FaceboxUrl); err != nil {
-		ok = false
-		msg += fmt.Sprintf("got this error while parsing the facebox url: %s", err)
+		errs.add("PeopleDir", peopleDirFlag, "the flag is not defined")
+	}
+	// When we re-evaluate a previous run the pictures come from the result index, not from picsdir.
+	if len(c.PicsDirs) == 0 && c.FilesFrom == "" && !c.Reevaluate {
+		errs.add("PicsDirs", picsDirFlag, "the flag is not defined")
+	}
+	for _, dir := range c.PicsDirs {
+		if c.PeopleDir == dir && c.PeopleDir != "" && dir != "" {
+			errs.add("PicsDirs", picsDirFlag, "the %s and %s flags cannot point to the same directory", peopleDirFlag, picsDirFlag)
+		}
+	}
+	peopleDirOk := false
+	if c.PeopleDir != "" {
+		if info, err := os.Stat(c.PeopleDir); os.IsNotExist(err) {
+			errs.add("PeopleDir", peopleDirFlag, "directory %s does not exist", c.PeopleDir)
+		} else if err != nil {
+			errs.add("PeopleDir", peopleDirFlag, "directory %s cannot be read; got error %s", c.PeopleDir, err)
+		} else if !info.IsDir() {
+			errs.add("PeopleDir", peopleDirFlag, "%s is not a directory", c.PeopleDir)
+		} else {
+			peopleDirOk = true
+		}
+	}
+	if c.Reevaluate {
+		if _, err := os.Stat(c.IndexPath); c.IndexPath == "" || err != nil {
+			errs.add("IndexPath", indexFlag, "the %s flag requires an existing result index", reevaluateFlag)
+		}
 	} else {
-		if u.Scheme == "" || u.Host == "" {
-			ok = false
-			msg += fmt.Sprint("malformed facebox url. try something like: http://localhost:8080")
+		for _, dir := range c.PicsDirs {
+			if info, err := os.Stat(dir); os.IsNotExist(err) {
+				errs.add("PicsDirs", picsDirFlag, "directory %s does not exist", dir)
+			} else if err != nil {
+				errs.add("PicsDirs", picsDirFlag, "directory %s cannot be read; got error %s", dir, err)
+			} else if !info.IsDir() && !isArchive(dir) {
+				errs.add("PicsDirs", picsDirFlag, "%s is not a directory", dir)
+			}
 		}
+		if c.FilesFrom != "" && c.FilesFrom != "-" {
+			if _, err := os.Stat(c.FilesFrom); err != nil {
+				errs.add("FilesFrom", filesFromFlag, "file %s does not exist", c.FilesFrom)
+			}
+		}
+	}
+	if urlOk, urlMsg := validateFaceboxUrl(c.FaceboxUrl); !urlOk {
+		errs.add("FaceboxUrl", faceboxUrlFlag, "%s", urlMsg)
+	}
+	if c.Unknown && c.UnknownDir == "" {
+		errs.add("UnknownDir", unknownDirFlag, "the %s flag requires this flag", unknownFlag)
+	} else if c.Unknown {
+		// The clusters are written inside the dir, so it shouldn't be one of the user's dirs.
+		unknownDir := absPath(c.resolve(c.UnknownDir))
+		for _, dir := range append([]string{c.WorkingDir, c.PeopleDir}, c.PicsDirs...) {
+			if dir != "" && unknownDir == absPath(dir) {
+				errs.add("UnknownDir", unknownDirFlag, "the flag cannot point to the working dir, the %s or a %s", peopleDirFlag, picsDirFlag)
+				break
+			}
+		}
+	}
+	if c.Crop && c.CropFormat != "jpeg" && c.CropFormat != "png" {
+		errs.add("CropFormat", cropFormatFlag, "the flag should be either jpeg or png")
+	}
+	if c.Formats != "" {
+		if formats, err := parseFormats(c.Formats); err != nil {
+			errs.add("Formats", formatsFlag, "%s", err)
+		} else {
+			c.AllowedFormats = formats
+		}
+	}
+	if c.MaxDimension < 0 {
+		errs.add("MaxDimension", maxDimensionFlag, "the flag cannot be negative")
+	}
+	if c.FrameStride < 0 {
+		errs.add("FrameStride", frameStrideFlag, "the flag cannot be negative")
+	}
+	if c.OutputArchive != "" && !isArchive(c.OutputArchive) {
+		errs.add("OutputArchive", outputArchiveFlag, "the flag should end with .zip, .tar, .tar.gz or .tgz")
+	}
+	if c.NearDuplicates != "" && c.NearDuplicates != nearDuplicatesKeepBest && c.NearDuplicates != nearDuplicatesGroup {
+		errs.add("NearDuplicates", nearDuplicatesFlag, "the flag should be either %s or %s", nearDuplicatesKeepBest, nearDuplicatesGroup)
+	}
+	if c.NearDuplicates != "" && c.OutputArchive != "" {
+		errs.add("NearDuplicates", nearDuplicatesFlag, "the flag cannot be used with the %s flag", outputArchiveFlag)
+	}
+	if c.NearDuplicateDistance < 0 || c.NearDuplicateDistance > 64 {
+		errs.add("NearDuplicateDistance", nearDuplicateDistFlag, "the flag should be a value between 0 and 64")
+	}
+	if _, err := parseLogLevel(c.LogLevel); err != nil {
+		errs.add("LogLevel", logLevelFlag, "the flag should be one of debug, info, warn or error")
+	}
+	if c.LogFormat != logFormatText && c.LogFormat != logFormatJSON {
+		errs.add("LogFormat", logFormatFlag, "the flag should be either %s or %s", logFormatText, logFormatJSON)
+	}
+	if c.MaxFailures < 0 {
+		errs.add("MaxFailures", maxFailuresFlag, "the flag cannot be negative")
+	}
+	if c.MaxDepth < 0 {
+		errs.add("MaxDepth", maxDepthFlag, "the flag cannot be negative")
+	}
+	for _, p := range c.Include {
+		if err := validatePattern(strings.TrimPrefix(p, "!")); err != nil {
+			errs.add("Include", includeFlag, "the flag should be a glob pattern: %s", err)
+		}
+	}
+	for _, p := range c.Exclude {
+		if err := validatePattern(strings.TrimPrefix(p, "!")); err != nil {
+			errs.add("Exclude", excludeFlag, "the flag should be a glob pattern: %s", err)
+		}
+	}
+	if c.CropPadding < 0 {
+		errs.add("CropPadding", cropPaddingFlag, "the flag cannot be negative")
+	}
+	if c.CropSize < 0 {
+		errs.add("CropSize", cropSizeFlag, "the flag cannot be negative")
+	}
+	if c.Annotate && c.ReviewDir == "" {
+		errs.add("ReviewDir", reviewDirFlag, "the %s flag requires this flag", annotateFlag)
 	}
 	if c.Combine != "" && len(c.PeopleCombined) == 1 {
-		ok = false
-		msg += "If you want to match multiple people in each picture you need to at least define two names " +
-			"in the combine flag."
+		errs.add("Combine", combineFlag, "if you want to match multiple people in each picture you need to at least "+
+			"define two names in the flag")
+	}
+
+	// Let's check the pictures in peopledir too, so every problem is reported before teaching
+	// facebox anything. The allowed formats should be known by now.
+	if peopleDirOk {
+		if err := collectPeoplePics(c); err != nil {
+			if problems, ok := err.(validationErrors); ok {
+				errs = append(errs, problems...)
+			} else {
+				errs.add("PeopleDir", peopleDirFlag, "directory %s cannot be read; got error %s", c.PeopleDir, err)
+			}
+		}
+
+		// If the client of the app wants to do multiple matches on each picture, the names in
+		// config.PeopleCombined should match the people in peopledir.
+		if c.MatchMultiple && len(c.People) > 0 && !c.CheckPeopleCombination() {
+			errs.add("Combine", combineFlag, "there is a mismatch with the names of the people defined in %s and "+
+				"the flag", peopleDirFlag)
+		}
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// absPath returns the cleaned absolute form of the given path, or the cleaned path itself if
+// it cannot be made absolute.
+func absPath(path string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		return abs
+	}
+	return filepath.Clean(path)
+}
+
+// resolve returns the location of the given path. Relative paths are relative to
+// config.WorkingDir, and absolute paths are left untouched.
+func (c *config) resolve(path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(c.WorkingDir, path)
+}
+
+// formatAllowed checks whether the user wants coalescer to read pictures in the given image format.
+func (c *config) formatAllowed(format string) bool {
+	for _, f := range c.AllowedFormats {
+		if f == format {
+			return true
+		}
+	}
+	return false
+}
+
+// validateFaceboxUrl validates the url of the facebox machine instance.
+func validateFaceboxUrl(rawUrl string) (ok bool, msg string) {
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return false, fmt.Sprintf("got this error while parsing the facebox url: %s", err)
 	}
-	if !ok {
-		msg += "For more information about the flags of this program, please run ./coalescer -h"
+	if u.Scheme == "" || u.Host == "" {
+		return false, fmt.Sprint("malformed facebox url. try something like: http://localhost:8080")
 	}
-	return
+	return true, ""
 }
 
 // CheckPeopleCombination checks whether the people defined in config.PeopleCombined can be
@@ -186,12 +449,46 @@ func parseFlags(programName string, args []string) (conf *config, output string,
 	}
 
 	flags.StringVar(&c.PeopleDir, peopleDirFlag, "", "Represents the dir where coalescer can find the photos of the people you want to recognize.")
-	flags.StringVar(&c.PicsDir, picsDirFlag, "", "Represents the dir where coalescer can find all the photos you want to filter out based on the people you want to recognize in peopledir.")
+	flags.Var(&c.PicsDirs, picsDirFlag, "Represents the dir where coalescer can find all the photos you want to filter out based on the people you want to recognize in peopledir. It can be repeated.")
+	flags.StringVar(&c.FilesFrom, filesFromFlag, "", "Represents a file with the paths of the photos you want to filter out, one per line or separated by NUL characters. Use - to read the paths from the standard input.")
 	flags.StringVar(&c.FaceboxUrl, faceboxUrlFlag, "", "Represents the url of the facebox machine instance.")
-	flags.BoolVar(&c.CoolDownPeriod, coolDownPeriodFlag, true, "Represents duration of the cooldown period needed to let facebox assimilate the people's pictures.")
+	flags.BoolVar(&c.CoolDownPeriod, coolDownPeriodFlag, true, "Specifies that coalescer should wait until facebox has assimilated the people's pictures before recognizing people.")
+	flags.DurationVar(&c.CoolDownTimeout, coolDownTimeoutFlag, 30*time.Second, "Represents the maximum duration coalescer will wait for facebox to assimilate the people's pictures.")
 	flags.Float64Var(&c.Confidence, confidenceFlag, 50, "Determines how confident coalescer is about the match of each picture. It should be a value between 1 and 99.")
 	flags.StringVar(&c.Combine, combineFlag, "", "Specifies the names of the people you want to recognize in each picture. Use this if you want to do a multiple match.")
 	flags.BoolVar(&c.Rigid, rigidFlag, false, "Specifies that in order to have a valid match all faces should appear in each picture exclusively.")
+	flags.BoolVar(&c.Reteach, reteachFlag, false, "Forces coalescer to remove and teach again all the people's pictures to facebox. Use this if your facebox instance was restarted.")
+	flags.StringVar(&c.ManifestPath, manifestFlag, "./coalescer.manifest.json", "Represents the file where coalescer keeps track of the pictures it has taught to facebox.")
+	flags.StringVar(&c.IndexPath, indexFlag, "", "Represents the file where coalescer stores the faces and faceprints found in each picture.")
+	flags.BoolVar(&c.Unknown, unknownFlag, false, "Specifies that coalescer should cluster the faces it couldn't match with anyone, so you can promote them to new people in peopledir.")
+	flags.StringVar(&c.UnknownDir, unknownDirFlag, "_unknown", "Represents the dir where coalescer stores the clusters of unknown faces.")
+	flags.Float64Var(&c.UnknownSimilarity, unknownSimilarityFlag, 60, "Determines how similar two unknown faces should be to belong to the same cluster. It should be a value between 1 and 99.")
+	flags.BoolVar(&c.Crop, cropFlag, false, "Specifies that coalescer should also store a crop of each recognized face next to each picture.")
+	flags.BoolVar(&c.CropOnly, cropOnlyFlag, false, "Specifies that coalescer should store a crop of each recognized face instead of each picture.")
+	flags.Float64Var(&c.CropPadding, cropPaddingFlag, 20, "Represents the padding around each face crop as a percentage of the size of the face.")
+	flags.IntVar(&c.CropSize, cropSizeFlag, 0, "Represents the size in pixels of the largest side of each face crop. Use 0 to keep the original size.")
+	flags.StringVar(&c.CropFormat, cropFormatFlag, "jpeg", "Represents the format of the face crops. It should be either jpeg or png.")
+	flags.BoolVar(&c.Annotate, annotateFlag, false, "Specifies that coalescer should store a copy of each picture with the rect, name and confidence of each face drawn onto it.")
+	flags.StringVar(&c.ReviewDir, reviewDirFlag, "_review", "Represents the dir where coalescer stores the annotated pictures.")
+	flags.BoolVar(&c.NormalizeOrientation, normalizeOrientationFlag, false, "Specifies that coalescer should send upright copies of the pictures with an EXIF orientation to facebox. The original pictures are copied untouched.")
+	flags.IntVar(&c.MaxDimension, maxDimensionFlag, 0, "Represents the size in pixels of the largest side of the pictures sent to facebox. Larger pictures are downscaled before uploading them. Use 0 to upload the original pictures.")
+	flags.StringVar(&c.Formats, formatsFlag, "jpeg,png", "Specifies the comma separated list of image formats coalescer should read. The supported formats are: "+supportedFormats()+".")
+	flags.IntVar(&c.FrameStride, frameStrideFlag, 0, "Specifies that coalescer should check every n-th frame of animated GIF and multi-page TIFF pictures. Use 0 to only check the first frame.")
+	flags.Var(&c.Include, includeFlag, "Specifies a glob pattern, e.g. *.jpg or 2020/**, of the files in picsdir coalescer should check. It can be repeated; by default every file is checked.")
+	flags.Var(&c.Exclude, excludeFlag, "Specifies a glob pattern, e.g. @eaDir, of the files and directories in picsdir coalescer should skip. It can be repeated.")
+	flags.IntVar(&c.MaxDepth, maxDepthFlag, 0, "Represents how many levels of directories of picsdir coalescer should walk, e.g. 1 only checks the files right inside picsdir. Use 0 to walk every level.")
+	flags.BoolVar(&c.SkipHidden, skipHiddenFlag, false, "Specifies that coalescer should skip the hidden files and directories of picsdir, the ones whose name starts with a dot.")
+	flags.StringVar(&c.OutputArchive, outputArchiveFlag, "", "Represents the zip or tar archive where coalescer stores the pictures of each person, instead of a folder per person.")
+	flags.BoolVar(&c.Dedupe, dedupeFlag, false, "Specifies that coalescer should only check and copy one of the pictures with the same content, and report the rest as duplicates.")
+	flags.StringVar(&c.NearDuplicates, nearDuplicatesFlag, "", "Specifies what coalescer should do with the near-duplicate pictures of each person, like burst shots or resized copies: keep-best keeps the one with the highest resolution, and group moves them to a subfolder.")
+	flags.IntVar(&c.NearDuplicateDistance, nearDuplicateDistFlag, 10, "Represents how many of the 64 bits of the perceptual hashes of two pictures can differ for them to be near-duplicates.")
+	flags.StringVar(&c.GalleryPath, galleryFlag, "", "Represents the HTML file where coalescer writes a gallery to review the results of the run.")
+	flags.StringVar(&c.LogFile, logFileFlag, "", "Represents the file where coalescer appends its log. By default coalescer logs to the standard error.")
+	flags.StringVar(&c.LogLevel, logLevelFlag, "info", "Represents the lowest level of the log entries coalescer writes. It should be one of debug, info, warn or error.")
+	flags.StringVar(&c.LogFormat, logFormatFlag, logFormatText, "Represents the format of the log entries. It should be either text or json, which writes one JSON object per line.")
+	flags.StringVar(&c.MetricsAddr, metricsAddrFlag, "", "Represents the address, e.g. :9090, where coalescer exposes Prometheus metrics on /metrics while it runs.")
+	flags.IntVar(&c.MaxFailures, maxFailuresFlag, 0, "Represents how many files can fail, e.g. because they are corrupt or facebox returned an error, before coalescer exits with the code 4. Pictures that don't match anyone aren't failures.")
+	flags.BoolVar(&c.Reevaluate, reevaluateFlag, false, "Specifies that coalescer should re-evaluate the pictures in the result index defined by the flag index instead of checking the pictures in picsdir again.")
 
 	err = flags.Parse(args)
 	if err != nil {
@@ -1,6 +1,9 @@
 package main
 
 import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 )
@@ -67,9 +70,9 @@ func TestConfig_Validate(t *testing.T) {
 				}
 				c.FaceboxUrl = "http://localhost:8080"
 				c.Confidence = 70
-				c.Combine = "pepe,julia"
+				c.Combine = "bill,mark"
 				c.MatchMultiple = true
-				c.PicsDir = testPicsDir
+				c.PicsDirs = stringList{testPicsDir}
 				c.PeopleDir = testPeopleDir
 				return c
 			},
@@ -86,13 +89,13 @@ func TestConfig_Validate(t *testing.T) {
 				c.Confidence = 70
 				c.Combine = "pepe,julia"
 				c.MatchMultiple = true
-				c.PicsDir = testPicsDir
+				c.PicsDirs = stringList{testPicsDir}
 				return c
 			},
 			shouldFail: true,
 		},
 		{
-			desc: "conf without PicsDir field should be invalid",
+			desc: "conf without PicsDirs field should be invalid",
 			getConf: func() *config {
 				c, err := newConfig()
 				if err != nil {
@@ -119,7 +122,7 @@ func TestConfig_Validate(t *testing.T) {
 				c.Combine = "pepe,julia"
 				c.MatchMultiple = true
 				c.PeopleDir = "same_dir"
-				c.PicsDir = "same_dir"
+				c.PicsDirs = stringList{"same_dir"}
 				return c
 			},
 			shouldFail: true,
@@ -135,7 +138,7 @@ func TestConfig_Validate(t *testing.T) {
 				c.Confidence = 70
 				c.Combine = "pepe,julia"
 				c.MatchMultiple = true
-				c.PicsDir = testPicsDir
+				c.PicsDirs = stringList{testPicsDir}
 				c.PeopleDir = "nonexistent"
 				return c
 			},
@@ -152,7 +155,7 @@ func TestConfig_Validate(t *testing.T) {
 				c.Confidence = 70
 				c.Combine = "pepe,julia"
 				c.MatchMultiple = true
-				c.PicsDir = "nonexistent"
+				c.PicsDirs = stringList{"nonexistent"}
 				c.PeopleDir = testPeopleDir
 				return c
 			},
@@ -169,8 +172,41 @@ func TestConfig_Validate(t *testing.T) {
 				c.Confidence = 70
 				c.Combine = "pepe"
 				c.MatchMultiple = true
-				c.PicsDir = testPicsDir
+				c.PicsDirs = stringList{testPicsDir}
+				c.PeopleDir = testPeopleDir
+				return c
+			},
+			shouldFail: true,
+		},
+		{
+			desc: "conf with a malformed exclude pattern should be invalid",
+			getConf: func() *config {
+				c, err := newConfig()
+				if err != nil {
+					t.Fatal(err)
+				}
+				c.FaceboxUrl = "http://localhost:8080"
+				c.Confidence = 70
+				c.PicsDirs = stringList{testPicsDir}
+				c.PeopleDir = testPeopleDir
+				c.Exclude = stringList{"[a-"}
+				return c
+			},
+			shouldFail: true,
+		},
+		{
+			desc: "conf with near-duplicates and an output archive should be invalid",
+			getConf: func() *config {
+				c, err := newConfig()
+				if err != nil {
+					t.Fatal(err)
+				}
+				c.FaceboxUrl = "http://localhost:8080"
+				c.Confidence = 70
+				c.PicsDirs = stringList{testPicsDir}
 				c.PeopleDir = testPeopleDir
+				c.NearDuplicates = nearDuplicatesGroup
+				c.OutputArchive = "people.zip"
 				return c
 			},
 			shouldFail: true,
@@ -180,13 +216,13 @@ func TestConfig_Validate(t *testing.T) {
 	for _, scenario := range scenarios {
 		if scenario.shouldFail {
 			c := scenario.getConf()
-			if ok, _ := c.Validate(); ok {
+			if err := c.Validate(); err == nil {
 				t.Errorf("conf should be invalid when testing scenario (%s)", scenario.desc)
 			}
 		} else {
 			c := scenario.getConf()
-			if ok, _ := c.Validate(); !ok {
-				t.Errorf("conf should be valid when testing scenario (%s)", scenario.desc)
+			if err := c.Validate(); err != nil {
+				t.Errorf("conf should be valid when testing scenario (%s); got error %s", scenario.desc, err)
 			}
 		}
 	}
@@ -238,15 +274,137 @@ func TestParseFlags(t *testing.T) {
 		t.Errorf("conf should have this value (\"people_dir\") on field PeopleDir; got %s instead.", conf.PeopleDir)
 	}
 
-	if conf.PicsDir != "pics_dir" {
-		t.Errorf("conf should have this value (\"pics_dir\") on field PicsDir; got %s instead.", conf.PicsDir)
+	if len(conf.PicsDirs) != 1 || conf.PicsDirs[0] != "pics_dir" {
+		t.Errorf("conf should have this value ([\"pics_dir\"]) on field PicsDirs; got %v instead.", conf.PicsDirs)
 	}
 
 	if conf.FaceboxUrl != "http://localhost:8080" {
 		t.Errorf("conf should have this value (\"http://localhost:8080\") on field FaceboxUrl; got %s instead.", conf.FaceboxUrl)
 	}
 
-	if ok, msg := conf.Validate(); !ok {
-		t.Errorf("conf should be valid got this message: %s", msg)
+	if err := conf.Validate(); err != nil {
+		t.Errorf("conf should be valid got this error: %s", err)
+	}
+}
+
+func TestConfig_Validate_reports_every_problem(t *testing.T) {
+	dir, err := ioutil.TempDir("", "coalescer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	billGates, err := ioutil.ReadFile(filepath.Join(testPeopleDir, "bill_gates_1.jpg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string][]byte{
+		"bill_1.jpg": billGates,
+		"bill.jpg":   billGates,
+		"mark_1.jpg": []byte("not a picture"),
+	}
+	for name, b := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), b, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c, err := newConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.FaceboxUrl = "localhost"
+	c.PeopleDir = dir
+	c.PicsDirs = stringList{testPicsDir}
+	c.MaxDepth = -1
+	c.LogFormat = "xml"
+
+	err = c.Validate()
+	problems, ok := err.(validationErrors)
+	if !ok {
+		t.Fatalf("Validate should return a validationErrors; got %v", err)
+	}
+	want := map[string]int{
+		faceboxUrlFlag: 1,
+		maxDepthFlag:   1,
+		logFormatFlag:  1,
+		peopleDirFlag:  2,
+	}
+	got := make(map[string]int)
+	for _, p := range problems {
+		got[p.Flag]++
+		if p.Field == "" || p.Reason == "" {
+			t.Errorf("every problem should have a field and a reason; got %+v", p)
+		}
+	}
+	for flag, n := range want {
+		if got[flag] != n {
+			t.Errorf("expected %d problems with the flag %s; got %d in %v", n, flag, got[flag], problems)
+		}
+	}
+	if len(problems) != 5 {
+		t.Errorf("expected 5 problems; got %v", problems)
+	}
+	if msg := err.Error(); !strings.Contains(msg, "bill.jpg") || !strings.Contains(msg, "mark_1.jpg") {
+		t.Errorf("expected the message to tell which pictures of peopledir are wrong; got %s", msg)
+	}
+}
+
+func TestConfig_Validate_unknown_dir(t *testing.T) {
+	for _, unknownDir := range []string{".", testPicsDir, testPeopleDir} {
+		c, err := newConfig()
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.FaceboxUrl = "http://localhost:8080"
+		c.PeopleDir = testPeopleDir
+		c.PicsDirs = stringList{testPicsDir}
+		c.Unknown = true
+		c.UnknownDir = unknownDir
+
+		err = c.Validate()
+		problems, ok := err.(validationErrors)
+		if !ok || len(problems) != 1 || problems[0].Field != "UnknownDir" {
+			t.Errorf("Validate should reject the unknown dir %s; got %v", unknownDir, err)
+		}
+	}
+}
+
+func TestConfig_Validate_combine_mismatch(t *testing.T) {
+	c, err := newConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.FaceboxUrl = "http://localhost:8080"
+	c.PeopleDir = testPeopleDir
+	c.PicsDirs = stringList{testPicsDir}
+	c.Combine = "bill,steve"
+
+	err = c.Validate()
+	problems, ok := err.(validationErrors)
+	if !ok || len(problems) != 1 || problems[0].Field != "Combine" || problems[0].Flag != combineFlag {
+		t.Errorf("Validate should report that steve has no pictures in peopledir; got %v", err)
+	}
+}
+
+func TestConfig_Validate_empty_peopledir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "coalescer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c, err := newConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.FaceboxUrl = "http://localhost:8080"
+	c.PeopleDir = dir
+	c.PicsDirs = stringList{testPicsDir}
+
+	err = c.Validate()
+	problems, ok := err.(validationErrors)
+	if !ok || len(problems) != 1 || problems[0].Field != "PeopleDir" {
+		t.Errorf("Validate should report that peopledir is empty; got %v", err)
 	}
 }
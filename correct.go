@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// correctCommandName is the name of the subcommand that applies the corrections of a reviewer.
+const correctCommandName = "correct"
+
+// correctCommand runs the correct subcommand with the given arguments, e.g.:
+//
+//	coalescer correct -peopledir=people_dir -faceboxurl=http://localhost:8080 -teach corrections.json
+//
+// The corrections file is the one exported from the gallery of a run. See writeGallery.
+func correctCommand(programName string, args []string) int {
+	flags := flag.NewFlagSet(programName, flag.ContinueOnError)
+	var buf bytes.Buffer
+	flags.SetOutput(&buf)
+	c, err := newConfig()
+	if err != nil {
+		return failWith(exitError, err)
+	}
+	var teach bool
+	flags.StringVar(&c.PeopleDir, peopleDirFlag, "", "Represents the dir where coalescer can find the photos of the people you want to recognize.")
+	flags.StringVar(&c.FaceboxUrl, faceboxUrlFlag, "", "Represents the url of the facebox machine instance.")
+	flags.StringVar(&c.ManifestPath, manifestFlag, "./coalescer.manifest.json", "Represents the file where coalescer keeps track of the pictures it has taught to facebox.")
+	flags.BoolVar(&teach, "teach", false, "Specifies that the faces confirmed in the missed matches should be taught to facebox as new pictures of each person.")
+	if err := flags.Parse(args); err != nil {
+		return failWith(exitConfig, fmt.Errorf("%s\n%s", err, buf.String()))
+	}
+	if flags.NArg() != 1 {
+		return failWith(exitConfig, fmt.Errorf("usage: %s [flags] <corrections file>", programName))
+	}
+	if teach {
+		if c.PeopleDir == "" {
+			return failWith(exitConfig, fmt.Errorf("the teach flag requires the %s flag", peopleDirFlag))
+		}
+		if ok, msg := validateFaceboxUrl(c.FaceboxUrl); !ok {
+			return failWith(exitConfig, errors.New(msg))
+		}
+		if err := connectFacebox(c.FaceboxUrl); err != nil {
+			return failWith(exitUnreachable, err)
+		}
+	}
+
+	b, err := ioutil.ReadFile(flags.Arg(0))
+	if err != nil {
+		return failWith(exitConfig, err)
+	}
+	var corr corrections
+	if err := json.Unmarshal(b, &corr); err != nil {
+		return failWith(exitConfig, fmt.Errorf("couldn't read the corrections %s; got error %s", flags.Arg(0), err))
+	}
+
+	if err := applyCorrections(c, &corr, teach); err != nil {
+		return failWith(exitCode(err), err)
+	}
+	return exitOK
+}
+
+// applyCorrections removes the false positives from the folders of each person or group and
+// copies the missed matches to them. If teach is true, the face confirmed in each missed match
+// of a single person is stored in config.PeopleDir and taught to facebox, so facebox won't miss
+// that person again.
+func applyCorrections(c *config, corr *corrections, teach bool) error {
+	for _, fp := range corr.FalsePositives {
+		folder := fp.Destination
+		if fp.Folder != "" {
+			folder = fp.Folder
+		}
+		if err := removeFromFolder(c, fp.Source, folder); err != nil {
+			return err
+		}
+	}
+
+	taught := 0
+	for _, missed := range corr.MissedMatches {
+		if err := os.MkdirAll(filepath.Join(c.WorkingDir, missed.Destination), 0755); err != nil {
+			return err
+		}
+		if err := copyPicture(c, missed.Source, missed.Destination); err != nil {
+			return err
+		}
+		if !teach || missed.Face == nil {
+			continue
+		}
+		// The folder of a group doesn't tell us whose face was confirmed.
+		if strings.Contains(missed.Destination, "_") {
+			fmt.Printf("The face confirmed in %s cannot be taught since %s is a group.\n", missed.Source, missed.Destination)
+			continue
+		}
+		if err := teachCorrection(c, missed); err != nil {
+			return err
+		}
+		taught++
+	}
+
+	fmt.Printf("Applied %d false positives and %d missed matches; taught %d new faces.\n",
+		len(corr.FalsePositives), len(corr.MissedMatches), taught)
+	return nil
+}
+
+// removeFromFolder removes the copy of the picture in the given path, and the face crops of
+// each of its frames, from the given folder. See copyFaceCrops and recognizeFrames.
+func removeFromFolder(c *config, path, folder string) error {
+	dir := filepath.Join(c.WorkingDir, folder)
+	crop := regexp.MustCompile(`^` + regexp.QuoteMeta(frameName(path, 0)) + `(_frame[0-9]+)?_face[0-9]+\.(jpg|png)$`)
+	files, err := ioutil.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	paths := []string{filepath.Join(dir, filepath.Base(path))}
+	for _, f := range files {
+		if !f.IsDir() && crop.MatchString(f.Name()) {
+			paths = append(paths, filepath.Join(dir, f.Name()))
+		}
+	}
+	for _, p := range paths {
+		if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// teachCorrection stores the face confirmed in the given missed match as a new picture of the
+// person in config.PeopleDir, teaches it to facebox and records it in the manifest.
+func teachCorrection(c *config, missed correction) error {
+	pic, err := loadPictureFrame(c.resolve(missed.Source), missed.Frame)
+	if err != nil {
+		return err
+	}
+	crop := pic.cropFace(*missed.Face, 0.2)
+	if crop.Bounds().Empty() {
+		return fmt.Errorf("the face confirmed in %s is outside of the picture", missed.Source)
+	}
+
+	// The name of the person should come first in the filename. See collectPeoplePics.
+	id := fmt.Sprintf("%s_correction_%s.jpg", missed.Destination, frameName(missed.Source, missed.Frame))
+	path := filepath.Join(c.resolve(c.PeopleDir), id)
+	if err := saveImage(path, crop, "jpeg"); err != nil {
+		return err
+	}
+
+	img, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	err = fbox.Teach(img, id, missed.Destination)
+	img.Close()
+	if err != nil {
+		return err
+	}
+
+	// Let's record what we taught so the next run doesn't teach it again.
+	hash, err := hashFile(path)
+	if err != nil {
+		return err
+	}
+	m, err := loadManifest(c.ManifestPath)
+	if err != nil {
+		return err
+	}
+	if m.FaceboxUrl != c.FaceboxUrl {
+		m = newManifest(c.FaceboxUrl)
+	}
+	m.Faces[id] = manifestEntry{Name: missed.Destination, Hash: hash}
+	return m.save(c.ManifestPath)
+}
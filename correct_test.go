@@ -0,0 +1,138 @@
+package main
+
+import (
+	"github.com/machinebox/sdk-go/facebox"
+	"image/color"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func Test_applyCorrections(t *testing.T) {
+	dir, err := ioutil.TempDir("", "coalescer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c, err := newConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.WorkingDir = dir
+	c.PeopleDir = "people"
+	c.FaceboxUrl = "http://localhost:8080"
+	c.ManifestPath = filepath.Join(dir, "manifest.json")
+
+	pic, err := ioutil.ReadFile("pics_dir/mark_and_bill.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := []string{
+		"pics/mark_and_bill.jpg",
+		"bill/mark_and_bill.jpg",
+		"bill/mark_and_bill_face1.jpg",
+		"bill/mark_and_bill_frame2_face1.jpg",
+		"bill/mark_and_bill_facepaint.jpg",
+		"mark/similar_01/mark_and_bill.jpg",
+	}
+	for _, d := range []string{"pics", "bill", "mark/similar_01", "people"} {
+		if err := os.MkdirAll(filepath.Join(dir, d), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, f := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, f), pic, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	recorder := &teachRecorder{known: make(map[string]string)}
+	originalFacebox := fbox
+	fbox = recorder
+	defer func(original recognizer) {
+		fbox = original
+	}(originalFacebox)
+
+	corr := &corrections{
+		FalsePositives: []correction{
+			{Destination: "bill", Source: "pics/mark_and_bill.jpg"},
+			{Destination: "mark", Source: "pics/mark_and_bill.jpg", Folder: "mark/similar_01"},
+		},
+		MissedMatches: []correction{
+			{Destination: "mark", Source: "pics/mark_and_bill.jpg", Face: &facebox.Rect{Top: 100, Left: 600, Width: 200, Height: 200}},
+			{Destination: "bill_mark", Source: "pics/mark_and_bill.jpg", Face: &facebox.Rect{Top: 100, Left: 600, Width: 200, Height: 200}},
+		},
+	}
+	if err := applyCorrections(c, corr, true); err != nil {
+		t.Fatalf("applyCorrections shouldn't fail; got error %s", err)
+	}
+
+	for _, f := range []string{"bill/mark_and_bill.jpg", "bill/mark_and_bill_face1.jpg", "bill/mark_and_bill_frame2_face1.jpg", "mark/similar_01/mark_and_bill.jpg"} {
+		if _, err := os.Stat(filepath.Join(dir, f)); err == nil {
+			t.Errorf("%s should have been removed", f)
+		}
+	}
+	for _, f := range []string{"bill/mark_and_bill_facepaint.jpg", "mark/mark_and_bill.jpg", "bill_mark/mark_and_bill.jpg", "people/mark_correction_mark_and_bill.jpg"} {
+		if _, err := os.Stat(filepath.Join(dir, f)); os.IsNotExist(err) {
+			t.Errorf("%s should exist", f)
+		}
+	}
+
+	// Only the face confirmed for mark can be taught, since bill_mark is a group.
+	if len(recorder.taught) != 1 || recorder.known["mark_correction_mark_and_bill.jpg"] != "mark" {
+		t.Errorf("expected the face of mark to be taught; got %v", recorder.taught)
+	}
+	m, err := loadManifest(c.ManifestPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Faces["mark_correction_mark_and_bill.jpg"].Name != "mark" {
+		t.Errorf("expected the face of mark to be recorded in the manifest; got %v", m.Faces)
+	}
+}
+
+func Test_teachCorrection_frame(t *testing.T) {
+	dir, err := ioutil.TempDir("", "coalescer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c, err := newConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.WorkingDir = dir
+	c.PeopleDir = "people"
+	c.ManifestPath = filepath.Join(dir, "manifest.json")
+	if err := os.Mkdir(filepath.Join(dir, "people"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	// The second frame paints the top left corner of the first one blue.
+	red, blue := color.RGBA{R: 255, A: 255}, color.RGBA{B: 255, A: 255}
+	if err := ioutil.WriteFile(filepath.Join(dir, "party.gif"), encodeGIF(t, 40, []color.Color{red, blue}), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	recorder := &teachRecorder{known: make(map[string]string)}
+	originalFacebox := fbox
+	fbox = recorder
+	defer func(original recognizer) {
+		fbox = original
+	}(originalFacebox)
+
+	missed := correction{Destination: "mark", Source: "party.gif", Face: &facebox.Rect{Width: 10, Height: 10}, Frame: 1}
+	if err := teachCorrection(c, missed); err != nil {
+		t.Fatalf("teachCorrection shouldn't fail; got error %s", err)
+	}
+
+	pic, err := loadPicture(filepath.Join(dir, "people", "mark_correction_party_frame1.jpg"))
+	if err != nil {
+		t.Fatalf("expected the face to be stored after the frame; got error %s", err)
+	}
+	if r, _, b, _ := pic.img.At(5, 5).RGBA(); b < r {
+		t.Errorf("expected the face to be cropped from the second frame")
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// seenContent keeps track of the content of the pictures that were checked, so the copies
+// of the same picture are only sent to facebox and copied once. It's safe to use from
+// several goroutines.
+type seenContent struct {
+	mu sync.Mutex
+
+	// paths maps the sha1 checksums of the contents that were claimed to the paths of the
+	// pictures that claimed them.
+	paths map[string]string
+}
+
+func newSeenContent() *seenContent {
+	return &seenContent{paths: make(map[string]string)}
+}
+
+// claim reads the content of the picture located in the given path from r. If it's the first
+// time claim sees that content it returns an empty string, and the caller should check the
+// picture. Otherwise it returns the path of the picture that claimed the content first.
+func (s *seenContent) claim(path string, r io.Reader) (string, error) {
+	h := sha1.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+	sum := fmt.Sprintf("%x", h.Sum(nil))
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if first, ok := s.paths[sum]; ok {
+		return first, nil
+	}
+	s.paths[sum] = path
+	return "", nil
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"github.com/machinebox/sdk-go/facebox"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func Test_recognizePictures_with_duplicates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "coalescer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	markAndBill, err := ioutil.ReadFile("pics_dir/mark_and_bill.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	billAndSteve, err := ioutil.ReadFile("pics_dir/bill_and_steve.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string][]byte{
+		"pics/mark_and_bill.jpg":                 markAndBill,
+		"pics/whatsapp/IMG-20190101-WA0001.jpg":  markAndBill,
+		"pics/backup/2019/mark_and_bill (1).jpg": markAndBill,
+		"pics/bill_and_steve.jpg":                billAndSteve,
+	}
+	for name, b := range files {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, b, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c, err := newConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.WorkingDir = dir
+	c.PicsDirs = stringList{filepath.Join(dir, "pics")}
+	c.People = PeopleToIdentify{"bill": nil, "mark": nil}
+	c.Confidence = 0.5
+	c.Dedupe = true
+	c.Seen = newSeenContent()
+	if err := createFoldersForPeople(c); err != nil {
+		t.Fatal(err)
+	}
+
+	var mu sync.Mutex
+	checks := 0
+	originalFacebox := fbox
+	fbox = &checkFuncRecognizer{check: func(r io.Reader) ([]facebox.Face, error) {
+		mu.Lock()
+		checks++
+		mu.Unlock()
+		return (&mockRecognizer{}).Check(r)
+	}}
+	defer func(original recognizer) {
+		fbox = original
+	}(originalFacebox)
+
+	done := make(chan struct{})
+	defer close(done)
+	ch, errc := recognizePictures(c, done)
+	var duplicates, successes []result
+	for re := range ch {
+		if re.duplicateOf != "" {
+			duplicates = append(duplicates, re)
+		} else if re.err == nil {
+			successes = append(successes, re)
+		}
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+
+	if checks != 2 {
+		t.Errorf("expected facebox to check 2 pictures; got %d", checks)
+	}
+	if len(successes) != 2 || len(duplicates) != 2 {
+		t.Fatalf("expected 2 successes and 2 duplicates; got %d and %d", len(successes), len(duplicates))
+	}
+	for _, dup := range duplicates {
+		if b, _ := ioutil.ReadFile(dup.duplicateOf); string(b) != string(markAndBill) {
+			t.Errorf("expected %s to be reported as a duplicate of a copy of mark_and_bill.jpg; got %s", dup.path, dup.duplicateOf)
+		}
+	}
+
+	// Only one copy should be copied to each destination.
+	for _, folder := range []string{"bill", "mark"} {
+		infos, err := ioutil.ReadDir(filepath.Join(dir, folder))
+		if err != nil {
+			t.Fatal(err)
+		}
+		copies := 0
+		for _, info := range infos {
+			if info.Size() == int64(len(markAndBill)) {
+				copies++
+			}
+		}
+		if copies != 1 {
+			t.Errorf("expected 1 copy of mark_and_bill.jpg in %s; got %d", folder, copies)
+		}
+	}
+
+	// The duplicates are kept in the result index too.
+	idx := newResultIndex(append(successes, duplicates...))
+	found := 0
+	for _, entry := range idx.Pictures {
+		if entry.DuplicateOf != "" {
+			found++
+		}
+	}
+	if found != 2 {
+		t.Errorf("expected 2 duplicates in the result index; got %d", found)
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/machinebox/sdk-go/facebox"
+	"image"
+	"io"
+	"io/ioutil"
+)
+
+// orientationTag is the EXIF tag that tells how the pixels of a picture should be
+// rotated or flipped to display it upright.
+const orientationTag = 0x0112
+
+// readOrientation returns the EXIF orientation of the JPEG picture in the given reader,
+// which is a value between 1 and 8. If the picture doesn't have an EXIF orientation
+// readOrientation returns 1, which means the picture is already upright.
+func readOrientation(r io.Reader) int {
+	// The EXIF data should be in one of the first segments of the file, and a segment
+	// cannot be larger than 64KB.
+	b, err := ioutil.ReadAll(io.LimitReader(r, 256<<10))
+	if err != nil {
+		return 1
+	}
+	if o := jpegOrientation(b); o >= 1 && o <= 8 {
+		return o
+	}
+	return 1
+}
+
+// jpegOrientation looks for the EXIF orientation in the APP1 segment of the given JPEG.
+func jpegOrientation(b []byte) int {
+	if len(b) < 4 || b[0] != 0xFF || b[1] != 0xD8 {
+		return 0
+	}
+	for i := 2; i+4 <= len(b); {
+		if b[i] != 0xFF {
+			return 0
+		}
+		marker := b[i+1]
+		// We reached the image data, so there is no EXIF orientation.
+		if marker == 0xDA || marker == 0xD9 {
+			return 0
+		}
+		size := int(binary.BigEndian.Uint16(b[i+2 : i+4]))
+		if size < 2 || i+2+size > len(b) {
+			return 0
+		}
+		segment := b[i+4 : i+2+size]
+		if marker == 0xE1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return tiffOrientation(segment[6:])
+		}
+		i += 2 + size
+	}
+	return 0
+}
+
+// tiffOrientation looks for the orientation tag in the first IFD of the given TIFF structure,
+// which is how EXIF data is stored.
+func tiffOrientation(b []byte) int {
+	if len(b) < 8 {
+		return 0
+	}
+	var order binary.ByteOrder
+	switch string(b[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 0
+	}
+	offset := int(order.Uint32(b[4:8]))
+	if offset+2 > len(b) {
+		return 0
+	}
+	entries := int(order.Uint16(b[offset : offset+2]))
+	for i := 0; i < entries; i++ {
+		entry := offset + 2 + i*12
+		if entry+12 > len(b) {
+			return 0
+		}
+		if order.Uint16(b[entry:entry+2]) == orientationTag {
+			return int(order.Uint16(b[entry+8 : entry+10]))
+		}
+	}
+	return 0
+}
+
+// applyOrientation returns a copy of the given image rotated and flipped according to the
+// given EXIF orientation, so it can be displayed upright.
+func applyOrientation(img image.Image, orientation int) image.Image {
+	if orientation < 2 || orientation > 8 {
+		return img
+	}
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		for x := 0; x < dw; x++ {
+			sx, sy := orientedSource(x, y, w, h, orientation)
+			dst.Set(x, y, img.At(b.Min.X+sx, b.Min.Y+sy))
+		}
+	}
+	return dst
+}
+
+// orientedSource returns the coordinates of the pixel in a w x h image that ends up in
+// the coordinates x, y of the upright image after applying the given EXIF orientation.
+func orientedSource(x, y, w, h, orientation int) (int, int) {
+	switch orientation {
+	case 2:
+		return w - 1 - x, y
+	case 3:
+		return w - 1 - x, h - 1 - y
+	case 4:
+		return x, h - 1 - y
+	case 5:
+		return y, x
+	case 6:
+		return y, h - 1 - x
+	case 7:
+		return w - 1 - y, h - 1 - x
+	case 8:
+		return w - 1 - y, x
+	}
+	return x, y
+}
+
+// unorientRect converts the given face rect in the coordinates of the upright picture to the
+// coordinates of the stored pixels of a w x h picture with the given EXIF orientation.
+// It is the inverse of orientRect.
+func unorientRect(r facebox.Rect, w, h, orientation int) facebox.Rect {
+	if r.Width <= 0 || r.Height <= 0 {
+		return r
+	}
+	x0, y0 := orientedSource(r.Left, r.Top, w, h, orientation)
+	x1, y1 := orientedSource(r.Left+r.Width-1, r.Top+r.Height-1, w, h, orientation)
+	rect := image.Rect(x0, y0, x1, y1)
+	return facebox.Rect{
+		Top:    rect.Min.Y,
+		Left:   rect.Min.X,
+		Width:  rect.Dx() + 1,
+		Height: rect.Dy() + 1,
+	}
+}
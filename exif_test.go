@@ -0,0 +1,83 @@
+package main
+
+import (
+	"github.com/machinebox/sdk-go/facebox"
+	"image"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func Test_unorientRect(t *testing.T) {
+	// The top quarter of a 40x20 picture rotated 90 degrees clockwise is the left quarter of its stored pixels.
+	got := unorientRect(facebox.Rect{Top: 0, Left: 0, Width: 20, Height: 10}, 40, 20, 6)
+	want := facebox.Rect{Top: 0, Left: 0, Width: 10, Height: 20}
+	if got != want {
+		t.Errorf("expected rect %v; got %v", want, got)
+	}
+
+	// unorientRect should undo orientRect.
+	for orientation := 1; orientation <= 8; orientation++ {
+		r := facebox.Rect{Top: 3, Left: 5, Width: 10, Height: 7}
+		upright := orientRect(r, 40, 20, orientation)
+		back := unorientRect(facebox.Rect{Top: upright.Min.Y, Left: upright.Min.X, Width: upright.Dx(), Height: upright.Dy()}, 40, 20, orientation)
+		if back != r {
+			t.Errorf("expected rect %v with orientation %d; got %v", r, orientation, back)
+		}
+	}
+}
+
+func Test_prepareForRecognition(t *testing.T) {
+	dir, err := ioutil.TempDir("", "coalescer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "rotated.jpg")
+	writeOrientedJPEG(t, path, 6)
+
+	c, err := newConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	scenarios := []struct {
+		normalize     bool
+		width, height int
+	}{
+		{normalize: false, width: 40, height: 20},
+		{normalize: true, width: 20, height: 40},
+	}
+	for _, scenario := range scenarios {
+		c.NormalizeOrientation = scenario.normalize
+		f, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, toStored, err := prepareForRecognition(c, f, image.Config{Width: 40, Height: 20}, "jpeg")
+		if err != nil {
+			t.Fatalf("prepareForRecognition shouldn't fail; got error %s", err)
+		}
+		cfg, _, err := image.DecodeConfig(r)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cfg.Width != scenario.width || cfg.Height != scenario.height {
+			t.Errorf("expected a %dx%d image with normalize=%t; got %dx%d",
+				scenario.width, scenario.height, scenario.normalize, cfg.Width, cfg.Height)
+		}
+
+		// The face rects should always end up in the coordinates of the stored pixels.
+		upright := facebox.Rect{Top: 0, Left: 0, Width: 20, Height: 10}
+		want := upright
+		if scenario.normalize {
+			want = facebox.Rect{Top: 0, Left: 0, Width: 10, Height: 20}
+		}
+		if got := toStored(upright); got != want {
+			t.Errorf("expected rect %v with normalize=%t; got %v", want, scenario.normalize, got)
+		}
+	}
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/machinebox/sdk-go/facebox"
+	"golang.org/x/image/tiff"
+	"image"
+	"image/draw"
+	"image/gif"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// frame represents a single frame of a picture with several frames, like an animated GIF
+// or a multi-page TIFF.
+type frame struct {
+	index int
+	img   image.Image
+}
+
+// hasFrames checks whether pictures in the given image format can have several frames.
+func hasFrames(format string) bool {
+	return format == "gif" || format == "tiff"
+}
+
+// decodeFrames decodes every stride-th frame of the given picture, starting with the first one.
+// Pictures in formats without frames are decoded as a single frame.
+func decodeFrames(r io.Reader, format string, stride int) ([]frame, error) {
+	if stride < 1 {
+		stride = 1
+	}
+	switch format {
+	case "gif":
+		return decodeGIFFrames(r, stride)
+	case "tiff":
+		return decodeTIFFPages(r, stride)
+	}
+	img, _, err := image.Decode(r)
+	if err != nil {
+		return nil, err
+	}
+	return []frame{{index: 0, img: img}}, nil
+}
+
+// decodeGIFFrames decodes every stride-th frame of the given animated GIF. The frames of a GIF
+// usually only hold what changed since the previous one, so each frame is drawn onto the frames
+// before it to get the picture a viewer would see.
+func decodeGIFFrames(r io.Reader, stride int) ([]frame, error) {
+	g, err := gif.DecodeAll(r)
+	if err != nil {
+		return nil, err
+	}
+	canvas := image.NewRGBA(image.Rect(0, 0, g.Config.Width, g.Config.Height))
+	var frames []frame
+	for i, img := range g.Image {
+		var disposal byte
+		if i < len(g.Disposal) {
+			disposal = g.Disposal[i]
+		}
+		var previous *image.RGBA
+		if disposal == gif.DisposalPrevious {
+			previous = cloneRGBA(canvas)
+		}
+
+		draw.Draw(canvas, img.Bounds(), img, img.Bounds().Min, draw.Over)
+		if i%stride == 0 {
+			frames = append(frames, frame{index: i, img: cloneRGBA(canvas)})
+		}
+
+		switch disposal {
+		case gif.DisposalBackground:
+			draw.Draw(canvas, img.Bounds(), image.Transparent, image.Point{}, draw.Src)
+		case gif.DisposalPrevious:
+			canvas = previous
+		}
+	}
+	return frames, nil
+}
+
+// cloneRGBA returns a copy of the given image.
+func cloneRGBA(img *image.RGBA) *image.RGBA {
+	c := image.NewRGBA(img.Bounds())
+	copy(c.Pix, img.Pix)
+	return c
+}
+
+// maxTIFFPages represents the maximum number of pages decodeTIFFPages reads, so a broken
+// chain of pages cannot keep us busy forever.
+const maxTIFFPages = 1000
+
+// decodeTIFFPages decodes every stride-th page of the given TIFF. The tiff package only
+// decodes the first page, so each page is decoded as if it was the first one.
+func decodeTIFFPages(r io.Reader, stride int) ([]frame, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	order, offsets, err := tiffPageOffsets(data)
+	if err != nil {
+		return nil, err
+	}
+	var frames []frame
+	for i, offset := range offsets {
+		if i%stride != 0 {
+			continue
+		}
+		img, err := tiff.Decode(&tiffPageReader{data: data, order: order, offset: offset})
+		if err != nil {
+			return nil, fmt.Errorf("couldn't decode page %d; got error %s", i, err)
+		}
+		frames = append(frames, frame{index: i, img: img})
+	}
+	return frames, nil
+}
+
+// tiffPageOffsets returns the byte order of the given TIFF and the offsets of its pages.
+func tiffPageOffsets(data []byte) (binary.ByteOrder, []uint32, error) {
+	if len(data) < 8 {
+		return nil, nil, fmt.Errorf("the TIFF header is incomplete")
+	}
+	var order binary.ByteOrder
+	switch string(data[:4]) {
+	case "II*\x00":
+		order = binary.LittleEndian
+	case "MM\x00*":
+		order = binary.BigEndian
+	default:
+		return nil, nil, fmt.Errorf("the TIFF header is invalid")
+	}
+
+	var offsets []uint32
+	seen := make(map[uint32]bool)
+	offset := order.Uint32(data[4:8])
+	for offset != 0 && !seen[offset] && len(offsets) < maxTIFFPages {
+		if int64(offset)+2 > int64(len(data)) {
+			break
+		}
+		seen[offset] = true
+		offsets = append(offsets, offset)
+
+		entries := int64(order.Uint16(data[offset : offset+2]))
+		next := int64(offset) + 2 + entries*12
+		if next+4 > int64(len(data)) {
+			break
+		}
+		offset = order.Uint32(data[next : next+4])
+	}
+	if len(offsets) == 0 {
+		return nil, nil, fmt.Errorf("the TIFF has no pages")
+	}
+	return order, offsets, nil
+}
+
+// tiffPageReader reads a TIFF whose header points to the page at the given offset instead
+// of to its first page.
+type tiffPageReader struct {
+	data   []byte
+	order  binary.ByteOrder
+	offset uint32
+	pos    int64
+}
+
+func (r *tiffPageReader) ReadAt(p []byte, off int64) (int, error) {
+	if off >= int64(len(r.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, r.data[off:])
+	var header [4]byte
+	r.order.PutUint32(header[:], r.offset)
+	for i := range header {
+		if at := 4 + int64(i) - off; at >= 0 && at < int64(n) {
+			p[at] = header[i]
+		}
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (r *tiffPageReader) Read(p []byte) (int, error) {
+	n, err := r.ReadAt(p, r.pos)
+	r.pos += int64(n)
+	return n, err
+}
+
+// encodeFrame returns the given frame as a JPEG that facebox accepts, downscaled to maxDimension
+// if it's set, and a function that converts the face rects facebox finds in it to the
+// coordinates of the frame.
+func encodeFrame(img image.Image, maxDimension int) (io.Reader, func(r facebox.Rect) facebox.Rect, error) {
+	scaled := img
+	if maxDimension > 0 && (img.Bounds().Dx() > maxDimension || img.Bounds().Dy() > maxDimension) {
+		scaled = resizeToFit(img, maxDimension)
+	}
+	var buf bytes.Buffer
+	if err := encodeImage(&buf, scaled, "jpeg"); err != nil {
+		return nil, nil, err
+	}
+	sx := float64(img.Bounds().Dx()) / float64(scaled.Bounds().Dx())
+	sy := float64(img.Bounds().Dy()) / float64(scaled.Bounds().Dy())
+	return &buf, func(r facebox.Rect) facebox.Rect {
+		return facebox.Rect{
+			Top:    int(float64(r.Top) * sy),
+			Left:   int(float64(r.Left) * sx),
+			Width:  int(float64(r.Width) * sx),
+			Height: int(float64(r.Height) * sy),
+		}
+	}, nil
+}
+
+// frameName returns the name, without extension, of the files coalescer derives from the frame
+// with the given index of the picture located in the given path, like its annotated copy or
+// its face crops. The first frame is simply named after the picture, e.g. x for x.gif, and
+// the rest after the picture and the frame, e.g. x_frame3.
+func frameName(path string, index int) string {
+	stem := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	if index == 0 {
+		return stem
+	}
+	return fmt.Sprintf("%s_frame%d", stem, index)
+}
+
+// loadPictureFrame decodes the frame with the given index of the picture located in the given path.
+func loadPictureFrame(path string, index int) (*picture, error) {
+	if index == 0 {
+		return loadPicture(path)
+	}
+	file, err := openFile(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	_, format, err := image.DecodeConfig(file)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	frames, err := decodeFrames(file, format, 1)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range frames {
+		if f.index == index {
+			return &picture{img: f.img, orientation: 1}, nil
+		}
+	}
+	return nil, fmt.Errorf("the picture has no frame %d", index)
+}
+
+// formatFrames describes the given map of destinations to frame indexes, e.g. "bill: 0, mark: 3".
+func formatFrames(frames map[string]int) string {
+	destinations := make([]string, 0, len(frames))
+	for dest := range frames {
+		destinations = append(destinations, dest)
+	}
+	sort.Strings(destinations)
+	parts := make([]string, 0, len(destinations))
+	for _, dest := range destinations {
+		parts = append(parts, fmt.Sprintf("%s: %d", dest, frames[dest]))
+	}
+	return strings.Join(parts, ", ")
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/machinebox/sdk-go/facebox"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/gif"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// encodeGIF returns an animated GIF with a frame of the given size for each of the given colours.
+// Each frame only covers the top left quarter of the picture, like the frames of a GIF that only
+// hold what changed.
+func encodeGIF(t *testing.T, size int, colors []color.Color) []byte {
+	g := &gif.GIF{Config: image.Config{Width: size, Height: size, ColorModel: color.Palette(palette.Plan9)}}
+	for i, col := range colors {
+		bounds := image.Rect(0, 0, size, size)
+		if i > 0 {
+			bounds = image.Rect(0, 0, size/2, size/2)
+		}
+		img := image.NewPaletted(bounds, palette.Plan9)
+		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+			for x := bounds.Min.X; x < bounds.Max.X; x++ {
+				img.Set(x, y, col)
+			}
+		}
+		g.Image = append(g.Image, img)
+		g.Delay = append(g.Delay, 10)
+		g.Disposal = append(g.Disposal, gif.DisposalNone)
+	}
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, g); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// encodeMultiPageTIFF returns an uncompressed grayscale TIFF with a page of the given size for
+// each of the given gray levels.
+func encodeMultiPageTIFF(size int, levels []uint8) []byte {
+	var buf bytes.Buffer
+	le := binary.LittleEndian
+	buf.WriteString("II*\x00")
+	binary.Write(&buf, le, uint32(8))
+	for i, level := range levels {
+		const entries = 8
+		ifdOffset := uint32(buf.Len())
+		stripOffset := ifdOffset + 2 + entries*12 + 4
+		next := uint32(0)
+		if i < len(levels)-1 {
+			next = stripOffset + uint32(size*size)
+		}
+		binary.Write(&buf, le, uint16(entries))
+		for _, tag := range [][3]uint32{
+			{256, 3, uint32(size)},        // ImageWidth
+			{257, 3, uint32(size)},        // ImageLength
+			{258, 3, 8},                   // BitsPerSample
+			{259, 3, 1},                   // Compression
+			{262, 3, 1},                   // PhotometricInterpretation
+			{273, 4, stripOffset},         // StripOffsets
+			{278, 3, uint32(size)},        // RowsPerStrip
+			{279, 4, uint32(size * size)}, // StripByteCounts
+		} {
+			binary.Write(&buf, le, uint16(tag[0]))
+			binary.Write(&buf, le, uint16(tag[1]))
+			binary.Write(&buf, le, uint32(1))
+			if tag[1] == 3 {
+				binary.Write(&buf, le, uint16(tag[2]))
+				binary.Write(&buf, le, uint16(0))
+			} else {
+				binary.Write(&buf, le, tag[2])
+			}
+		}
+		binary.Write(&buf, le, next)
+		buf.Write(bytes.Repeat([]byte{level}, size*size))
+	}
+	return buf.Bytes()
+}
+
+func Test_decodeGIFFrames(t *testing.T) {
+	red := color.RGBA{R: 0xff, A: 0xff}
+	green := color.RGBA{G: 0xff, A: 0xff}
+	blue := color.RGBA{B: 0xff, A: 0xff}
+	b := encodeGIF(t, 8, []color.Color{red, green, red, blue})
+
+	frames, err := decodeFrames(bytes.NewReader(b), "gif", 2)
+	if err != nil {
+		t.Fatalf("decodeFrames shouldn't fail; got error %s", err)
+	}
+	if len(frames) != 2 || frames[0].index != 0 || frames[1].index != 2 {
+		t.Fatalf("expected the frames 0 and 2; got %v", frames)
+	}
+	// The third frame only covers the top left quarter, the rest comes from the first frame.
+	if got := frames[1].img.At(1, 1); !closeTo(got, red) {
+		t.Errorf("expected the top left corner of frame 2 to be red; got %v", got)
+	}
+	if got := frames[1].img.At(6, 6); !closeTo(got, red) {
+		t.Errorf("expected the bottom right corner of frame 2 to come from frame 0; got %v", got)
+	}
+
+	frames, err = decodeFrames(bytes.NewReader(b), "gif", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(frames) != 4 {
+		t.Fatalf("expected 4 frames; got %d", len(frames))
+	}
+	if got := frames[3].img.At(1, 1); !closeTo(got, blue) {
+		t.Errorf("expected the top left corner of frame 3 to be blue; got %v", got)
+	}
+}
+
+func Test_decodeTIFFPages(t *testing.T) {
+	b := encodeMultiPageTIFF(4, []uint8{10, 128, 250})
+
+	frames, err := decodeFrames(bytes.NewReader(b), "tiff", 2)
+	if err != nil {
+		t.Fatalf("decodeFrames shouldn't fail; got error %s", err)
+	}
+	if len(frames) != 2 || frames[0].index != 0 || frames[1].index != 2 {
+		t.Fatalf("expected the pages 0 and 2; got %v", frames)
+	}
+	for i, want := range []uint8{10, 250} {
+		if got := color.GrayModel.Convert(frames[i].img.At(1, 1)).(color.Gray).Y; got != want {
+			t.Errorf("expected page %d to have the gray level %d; got %d", frames[i].index, want, got)
+		}
+	}
+
+	if _, err := decodeFrames(bytes.NewReader([]byte("not a tiff")), "tiff", 1); err == nil {
+		t.Errorf("decodeFrames should fail with an invalid TIFF")
+	}
+}
+
+func Test_recognizeFrames(t *testing.T) {
+	dir, err := ioutil.TempDir("", "coalescer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Only the white frame, the third one, shows bill.
+	black := color.RGBA{A: 0xff}
+	white := color.RGBA{R: 0xff, G: 0xff, B: 0xff, A: 0xff}
+	b := encodeGIF(t, 16, []color.Color{black, black, white})
+	if err := ioutil.WriteFile(filepath.Join(dir, "anim.gif"), b, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := newConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.WorkingDir = dir
+	c.People = PeopleToIdentify{"bill": nil}
+	c.Confidence = 0.5
+	c.AllowedFormats = []string{"gif"}
+	if err := os.Mkdir(filepath.Join(dir, "bill"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	originalFacebox := fbox
+	fbox = &checkFuncRecognizer{check: func(r io.Reader) ([]facebox.Face, error) {
+		img, format, err := image.Decode(r)
+		if err != nil {
+			return nil, err
+		}
+		if format != "jpeg" {
+			t.Errorf("facebox should receive each frame as a JPEG; got %s", format)
+		}
+		if cr, _, _, _ := img.At(2, 2).RGBA(); cr < 0x8000 {
+			return nil, nil
+		}
+		return []facebox.Face{{Name: "bill", Matched: true, Confidence: 0.7}}, nil
+	}}
+	defer func(original recognizer) {
+		fbox = original
+	}(originalFacebox)
+
+	for _, stride := range []int{1, 2} {
+		c.FrameStride = stride
+		re := recognizeAndCopy(c, "anim.gif")
+		if re.err != nil {
+			t.Fatalf("recognizeAndCopy shouldn't fail with a stride of %d; got error %s", stride, re.err)
+		}
+		if len(re.destinations) != 1 || re.destinations[0] != "bill" {
+			t.Errorf("expected the destination bill; got %v", re.destinations)
+		}
+		if frame, ok := re.frames["bill"]; !ok || frame != 2 || re.frame != 2 {
+			t.Errorf("expected bill to match in frame 2; got frames %v and frame %d", re.frames, re.frame)
+		}
+		copied, err := ioutil.ReadFile(filepath.Join(dir, "bill", "anim.gif"))
+		if err != nil || !bytes.Equal(copied, b) {
+			t.Errorf("the original picture should be copied untouched to bill")
+		}
+	}
+
+	// With a stride of 3 only the first frame is checked.
+	c.FrameStride = 3
+	if re := recognizeAndCopy(c, "anim.gif"); re.err == nil {
+		t.Errorf("recognizeAndCopy should fail when no sampled frame matches")
+	}
+}
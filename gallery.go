@@ -0,0 +1,314 @@
+package main
+
+import (
+	"fmt"
+	"github.com/machinebox/sdk-go/facebox"
+	"html/template"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// corrections represents the marks of a reviewer on the gallery of a run. The gallery exports
+// them as a JSON file so they can be applied later on.
+type corrections struct {
+	// FalsePositives holds the pictures that were copied to a folder they don't belong to.
+	FalsePositives []correction `json:"false_positives"`
+
+	// MissedMatches holds the pictures that should have been copied to a folder but weren't.
+	MissedMatches []correction `json:"missed_matches"`
+}
+
+// correction represents a single mark of a reviewer.
+type correction struct {
+	// Destination is the name of the folder of a person or group.
+	Destination string `json:"destination"`
+
+	// Source is the path of the original picture.
+	Source string `json:"source"`
+
+	// Folder is the subfolder of the destination the copy of a false positive was moved to,
+	// e.g. bill/similar_01, if any.
+	Folder string `json:"folder,omitempty"`
+
+	// Face is the face the reviewer confirmed in a missed match, if any.
+	Face *facebox.Rect `json:"face,omitempty"`
+
+	// Frame is the index of the frame the face was found in. It's only set for pictures
+	// with several frames.
+	Frame int `json:"frame,omitempty"`
+}
+
+// galleryThumbnailSize is the size in pixels of the largest side of the thumbnails in the gallery.
+const galleryThumbnailSize = 400
+
+// galleryThumbnail represents a picture in the gallery.
+type galleryThumbnail struct {
+	Src         string
+	Href        string
+	Source      string
+	Folder      string
+	Name        string
+	Confidences string
+}
+
+// galleryFailure represents a picture that coalescer couldn't classify.
+type galleryFailure struct {
+	Src    string
+	Href   string
+	Source string
+	Reason string
+	Frame  int
+	Faces  []galleryFace
+}
+
+// galleryFace represents a face in a picture that coalescer couldn't classify.
+type galleryFace struct {
+	Label string
+	Rect  facebox.Rect
+}
+
+// gallerySection represents the pictures copied to the folder of a person or group.
+type gallerySection struct {
+	Destination string
+	Thumbnails  []galleryThumbnail
+}
+
+// writeGallery writes a self-contained HTML page to config.GalleryPath with the results of a run.
+// The thumbnails are stored in a folder next to the page, e.g. review_thumbs for review.html,
+// and they and the pictures are linked relative to the page so it can be browsed from disk
+// without a server.
+func writeGallery(c *config, results []result) error {
+	galleryPath := c.resolve(c.GalleryPath)
+	galleryDir := filepath.Dir(galleryPath)
+	thumbsDir := strings.TrimSuffix(galleryPath, filepath.Ext(galleryPath)) + "_thumbs"
+	if err := os.MkdirAll(thumbsDir, 0755); err != nil {
+		return err
+	}
+	rel := func(path string) string {
+		r, err := filepath.Rel(galleryDir, c.resolve(path))
+		if err != nil {
+			return path
+		}
+		return filepath.ToSlash(r)
+	}
+
+	// thumbnails maps the path of each picture to its thumbnail, so the pictures copied to
+	// several folders are only downscaled once.
+	thumbnails := make(map[string]string)
+	thumbnail := func(path string) string {
+		if thumb, ok := thumbnails[path]; ok {
+			return thumb
+		}
+		name := fmt.Sprintf("%d_%s.jpg", len(thumbnails)+1, frameName(path, 0))
+		thumb := filepath.Join(thumbsDir, name)
+		if err := writeThumbnail(c.resolve(path), thumb); err != nil {
+			_logger.Warn("Cannot create the thumbnail for the gallery", field("path", path), field("error", err))
+			thumb = path
+		}
+		thumbnails[path] = rel(thumb)
+		return thumbnails[path]
+	}
+	// original returns the link to the given picture, or to its thumbnail if the picture is
+	// inside an archive, since browsers cannot open those.
+	original := func(path string) string {
+		if _, _, ok := splitArchivePath(c.resolve(path)); ok {
+			return thumbnail(path)
+		}
+		return rel(path)
+	}
+
+	sections := make(map[string]*gallerySection)
+	var failures []galleryFailure
+	for _, re := range results {
+		if re.err != nil {
+			failure := galleryFailure{Src: thumbnail(re.path), Href: original(re.path), Source: re.path, Reason: re.err.Error(), Frame: re.frame}
+			for i, face := range re.faces {
+				label := fmt.Sprintf("face %d: unknown", i+1)
+				if face.Matched {
+					label = fmt.Sprintf("face %d: %s %.2f", i+1, face.Name, face.Confidence)
+				}
+				failure.Faces = append(failure.Faces, galleryFace{Label: label, Rect: face.Rect})
+			}
+			failures = append(failures, failure)
+			continue
+		}
+		for _, dest := range re.destinations {
+			section, ok := sections[dest]
+			if !ok {
+				section = &gallerySection{Destination: dest}
+				sections[dest] = section
+			}
+			// When we only store the face crops, or the pictures are stored in an archive,
+			// the original picture is the one to review.
+			href := original(re.path)
+			if !c.CropOnly && c.OutputArchive == "" {
+				href = rel(filepath.Join(re.folder(dest), filepath.Base(re.path)))
+			}
+			var confidences []string
+			for _, face := range re.faces {
+				if recognized(c, face) {
+					confidences = append(confidences, fmt.Sprintf("%s %.2f", face.Name, face.Confidence))
+				}
+			}
+			section.Thumbnails = append(section.Thumbnails, galleryThumbnail{
+				Src:         thumbnail(re.path),
+				Href:        href,
+				Source:      re.path,
+				Folder:      re.folders[dest],
+				Name:        filepath.Base(re.path),
+				Confidences: strings.Join(confidences, ", "),
+			})
+		}
+	}
+
+	var destinations []string
+	if c.MatchMultiple {
+		destinations = []string{c.PeopleCombinedDirName}
+	} else {
+		for name := range c.People {
+			destinations = append(destinations, name)
+		}
+	}
+	sort.Strings(destinations)
+
+	var data struct {
+		Sections     []*gallerySection
+		Failures     []galleryFailure
+		Destinations []string
+	}
+	for _, dest := range destinations {
+		if section, ok := sections[dest]; ok {
+			sort.Slice(section.Thumbnails, func(i, j int) bool {
+				return section.Thumbnails[i].Source < section.Thumbnails[j].Source
+			})
+			data.Sections = append(data.Sections, section)
+		}
+	}
+	sort.Slice(failures, func(i, j int) bool {
+		return failures[i].Source < failures[j].Source
+	})
+	data.Failures = failures
+	data.Destinations = destinations
+
+	f, err := os.Create(galleryPath)
+	if err != nil {
+		return err
+	}
+	if err := galleryTemplate.Execute(f, data); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// writeThumbnail writes an upright JPEG copy of the picture located in the given path to thumb,
+// downscaled so its largest side measures galleryThumbnailSize at most.
+func writeThumbnail(path, thumb string) error {
+	pic, err := loadPicture(path)
+	if err != nil {
+		return err
+	}
+	img := applyOrientation(pic.img, pic.orientation)
+	b := img.Bounds()
+	if b.Dx() > galleryThumbnailSize || b.Dy() > galleryThumbnailSize {
+		img = resizeToFit(img, galleryThumbnailSize)
+	}
+	return saveImage(thumb, img, "jpeg")
+}
+
+var galleryTemplate = template.Must(template.New("gallery").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>coalescer review</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+.grid { display: flex; flex-wrap: wrap; gap: 1em; }
+.thumb { width: 200px; }
+.thumb img { width: 200px; height: 200px; object-fit: cover; }
+.thumb small { display: block; color: #555; }
+table { border-collapse: collapse; }
+td { border-bottom: 1px solid #ddd; padding: 0.5em; vertical-align: top; }
+td img { width: 120px; }
+</style>
+</head>
+<body>
+<h1>coalescer review</h1>
+<p>Mark the pictures that don't belong to a folder and confirm the matches coalescer missed, then export the corrections.</p>
+<button onclick="exportCorrections()">Export corrections</button>
+{{range .Sections}}
+<h2>{{.Destination}} ({{len .Thumbnails}})</h2>
+<div class="grid">
+{{- $dest := .Destination}}
+{{- range .Thumbnails}}
+<div class="thumb">
+<a href="{{.Href}}"><img src="{{.Src}}" alt="{{.Name}}" loading="lazy"></a>
+<small>{{.Name}}</small>
+<small>{{.Confidences}}</small>
+<label><input type="checkbox" class="false-positive" data-destination="{{$dest}}" data-source="{{.Source}}" data-folder="{{.Folder}}"> wrong</label>
+</div>
+{{- end}}
+</div>
+{{end}}
+<h2>Failures ({{len .Failures}})</h2>
+<table>
+{{- $destinations := .Destinations}}
+{{- range .Failures}}
+<tr class="failure" data-source="{{.Source}}" data-frame="{{.Frame}}">
+<td><a href="{{.Href}}"><img src="{{.Src}}" alt="{{.Source}}" loading="lazy"></a></td>
+<td>{{.Source}}<br><small>{{.Reason}}</small></td>
+<td>
+<select class="missed-destination">
+<option value="">no match</option>
+{{- range $destinations}}
+<option value="{{.}}">{{.}}</option>
+{{- end}}
+</select>
+{{- if .Faces}}
+<select class="missed-face">
+<option value="">no face</option>
+{{- range .Faces}}
+<option value="{{.Rect.Top}},{{.Rect.Left}},{{.Rect.Width}},{{.Rect.Height}}">{{.Label}}</option>
+{{- end}}
+</select>
+{{- end}}
+</td>
+</tr>
+{{- end}}
+</table>
+<script>
+function exportCorrections() {
+  var corrections = {false_positives: [], missed_matches: []};
+  document.querySelectorAll(".false-positive:checked").forEach(function (el) {
+    var fp = {destination: el.dataset.destination, source: el.dataset.source};
+    if (el.dataset.folder !== "") {
+      fp.folder = el.dataset.folder;
+    }
+    corrections.false_positives.push(fp);
+  });
+  document.querySelectorAll(".failure").forEach(function (row) {
+    var destination = row.querySelector(".missed-destination").value;
+    if (destination === "") {
+      return;
+    }
+    var missed = {destination: destination, source: row.dataset.source};
+    var face = row.querySelector(".missed-face");
+    if (face && face.value !== "") {
+      var r = face.value.split(",").map(Number);
+      missed.face = {Top: r[0], Left: r[1], Width: r[2], Height: r[3]};
+      missed.frame = Number(row.dataset.frame);
+    }
+    corrections.missed_matches.push(missed);
+  });
+  var blob = new Blob([JSON.stringify(corrections, null, 2)], {type: "application/json"});
+  var a = document.createElement("a");
+  a.href = URL.createObjectURL(blob);
+  a.download = "corrections.json";
+  a.click();
+}
+</script>
+</body>
+</html>
+`))
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"github.com/machinebox/sdk-go/facebox"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func Test_writeGallery(t *testing.T) {
+	dir, err := ioutil.TempDir("", "coalescer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c, err := newConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.WorkingDir = dir
+	c.GalleryPath = "review/index.html"
+	c.People = PeopleToIdentify{"bill": nil, "mark": nil}
+	c.Confidence = 0.5
+	for _, d := range []string{"review", "pics_dir"} {
+		if err := os.Mkdir(filepath.Join(dir, d), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := saveImage(filepath.Join(dir, "pics_dir", "mark_and_bill.jpg"), gradient(800, 400, false), "jpeg"); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := encodeImage(&buf, gradient(100, 50, false), "jpeg"); err != nil {
+		t.Fatal(err)
+	}
+	writeZip(t, filepath.Join(dir, "backup.zip"), map[string][]byte{"beach.jpg": buf.Bytes()})
+
+	results := []result{
+		{
+			path:         "pics_dir/mark_and_bill.jpg",
+			faces:        []facebox.Face{{Name: "bill", Matched: true, Confidence: 0.7}, {Name: "mark", Matched: true, Confidence: 0.8}},
+			destinations: []string{"bill", "mark"},
+		},
+		{
+			path:  "pics_dir/bill_and_steve.jpg",
+			faces: []facebox.Face{{Rect: facebox.Rect{Top: 1, Left: 2, Width: 3, Height: 4}}},
+			err:   errors.New("there is no match with a confidence 0.50"),
+		},
+		{
+			path: "backup.zip/beach.jpg",
+			err:  errors.New("there are no faces in the picture"),
+		},
+	}
+
+	if err := writeGallery(c, results); err != nil {
+		t.Fatalf("writeGallery shouldn't fail; got error %s", err)
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(dir, c.GalleryPath))
+	if err != nil {
+		t.Fatal(err)
+	}
+	html := string(b)
+
+	expected := []string{
+		"<h2>bill (1)</h2>",
+		"<h2>mark (1)</h2>",
+		`<a href="../bill/mark_and_bill.jpg"><img src="index_thumbs/1_mark_and_bill.jpg"`,
+		`<a href="../mark/mark_and_bill.jpg"><img src="index_thumbs/1_mark_and_bill.jpg"`,
+		"bill 0.70, mark 0.80",
+		"<h2>Failures (2)</h2>",
+		// The picture cannot be decoded, so the gallery falls back to the original.
+		`<a href="../pics_dir/bill_and_steve.jpg"><img src="../pics_dir/bill_and_steve.jpg"`,
+		// Browsers cannot open the pictures inside archives, so they link to their thumbnail.
+		`<a href="index_thumbs/3_beach.jpg"><img src="index_thumbs/3_beach.jpg"`,
+		"there is no match with a confidence 0.50",
+		`<option value="1,2,3,4">face 1: unknown</option>`,
+	}
+	for _, s := range expected {
+		if !strings.Contains(html, s) {
+			t.Errorf("expected the gallery to contain %q", s)
+		}
+	}
+
+	for name, size := range map[string]int{"1_mark_and_bill.jpg": galleryThumbnailSize, "3_beach.jpg": 100} {
+		pic, err := loadPicture(filepath.Join(dir, "review", "index_thumbs", name))
+		if err != nil {
+			t.Fatalf("expected the thumbnail %s to be written; got error %s", name, err)
+		}
+		if w := pic.img.Bounds().Dx(); w != size {
+			t.Errorf("expected the thumbnail %s to be %d pixels wide; got %d", name, size, w)
+		}
+	}
+}
@@ -5,4 +5,5 @@ go 1.14
 require (
 	github.com/machinebox/sdk-go v0.3.1
 	github.com/pkg/errors v0.9.1 // indirect
+	golang.org/x/image v0.0.0-20200618115811-c13761719519
 )
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/machinebox/sdk-go/facebox"
+	_ "golang.org/x/image/bmp"
+	_ "golang.org/x/image/tiff"
+	_ "golang.org/x/image/webp"
+	"image"
+	"image/color"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+)
+
+// imageFormats holds the names of the image formats coalescer can read. The decoder of each
+// format registers itself in the image package when its package is imported above, so adding
+// a format is a matter of importing its package and adding its name here.
+var imageFormats = map[string]bool{
+	"jpeg": true,
+	"png":  true,
+	"gif":  true,
+	"bmp":  true,
+	"tiff": true,
+	"webp": true,
+}
+
+// supportedFormats returns the names of the image formats coalescer can read.
+func supportedFormats() string {
+	formats := make([]string, 0, len(imageFormats))
+	for f := range imageFormats {
+		formats = append(formats, f)
+	}
+	sort.Strings(formats)
+	return strings.Join(formats, ", ")
+}
+
+// recognizerAccepts checks whether facebox accepts pictures in the given image format.
+// Pictures in any other format are converted to JPEG before sending them to facebox.
+func recognizerAccepts(format string) bool {
+	return format == "jpeg" || format == "png"
+}
+
+// parseFormats parses the given comma separated list of image formats.
+func parseFormats(list string) ([]string, error) {
+	var formats []string
+	for _, f := range strings.Split(list, ",") {
+		f = strings.ToLower(strings.TrimSpace(f))
+		if f == "jpg" {
+			f = "jpeg"
+		}
+		if f == "tif" {
+			f = "tiff"
+		}
+		if !imageFormats[f] {
+			return nil, fmt.Errorf("unsupported image format %q; the supported formats are: %s", f, supportedFormats())
+		}
+		formats = append(formats, f)
+	}
+	return formats, nil
+}
+
+// openForRecognizer opens the picture located in the given path in a format facebox accepts.
+func openForRecognizer(path string) (io.ReadCloser, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	_, format, err := image.DecodeConfig(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		file.Close()
+		return nil, err
+	}
+	if recognizerAccepts(format) {
+		return file, nil
+	}
+	defer file.Close()
+	img, _, err := image.Decode(file)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := encodeImage(&buf, img, "jpeg"); err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(&buf), nil
+}
+
+// picture represents a decoded picture and its EXIF orientation. The pixels of the image
+// are stored as they are in the file, which is also how facebox sees them, so the face rects
+// facebox returns can be applied directly to the image.
+type picture struct {
+	img         image.Image
+	orientation int
+}
+
+// loadPicture decodes the picture located in the given path.
+func loadPicture(path string) (*picture, error) {
+	file, err := openFile(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	orientation := readOrientation(file)
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	img, _, err := image.Decode(file)
+	if err != nil {
+		return nil, err
+	}
+	return &picture{img: img, orientation: orientation}, nil
+}
+
+// cropFace returns the upright face delimited by the given face rect. The rect is
+// enlarged on each side by the given padding, which is a fraction of the size of the face.
+func (p *picture) cropFace(r facebox.Rect, padding float64) image.Image {
+	padX := int(float64(r.Width) * padding)
+	padY := int(float64(r.Height) * padding)
+	rect := image.Rect(r.Left-padX, r.Top-padY, r.Left+r.Width+padX, r.Top+r.Height+padY)
+	rect = rect.Intersect(p.img.Bounds())
+
+	// We copy the pixels so the crop doesn't keep a reference to the whole image.
+	crop := image.NewRGBA(image.Rect(0, 0, rect.Dx(), rect.Dy()))
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		for x := rect.Min.X; x < rect.Max.X; x++ {
+			crop.Set(x-rect.Min.X, y-rect.Min.Y, p.img.At(x, y))
+		}
+	}
+	return applyOrientation(crop, p.orientation)
+}
+
+// resizeToFit scales the given image so that its largest side measures the given size.
+// Each pixel of the resized image is the average of the pixels it covers in the original.
+func resizeToFit(img image.Image, size int) image.Image {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if size <= 0 || w == 0 || h == 0 {
+		return img
+	}
+	dw, dh := size, size
+	if w > h {
+		dh = h * size / w
+	} else {
+		dw = w * size / h
+	}
+	if dw < 1 {
+		dw = 1
+	}
+	if dh < 1 {
+		dh = 1
+	}
+	if dw == w && dh == h {
+		return img
+	}
+	return resize(img, dw, dh)
+}
+
+// resize scales the given image to the given width and height.
+func resize(img image.Image, dw, dh int) image.Image {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		y0, y1 := b.Min.Y+y*h/dh, b.Min.Y+(y+1)*h/dh
+		if y1 <= y0 {
+			y1 = y0 + 1
+		}
+		for x := 0; x < dw; x++ {
+			x0, x1 := b.Min.X+x*w/dw, b.Min.X+(x+1)*w/dw
+			if x1 <= x0 {
+				x1 = x0 + 1
+			}
+			var r, g, bl, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					pr, pg, pb, pa := img.At(sx, sy).RGBA()
+					r, g, bl, a, n = r+uint64(pr), g+uint64(pg), bl+uint64(pb), a+uint64(pa), n+1
+				}
+			}
+			dst.Set(x, y, color.RGBA64{R: uint16(r / n), G: uint16(g / n), B: uint16(bl / n), A: uint16(a / n)})
+		}
+	}
+	return dst
+}
+
+// encodeImage writes the given image to w in the given format, which should be jpeg or png.
+func encodeImage(w io.Writer, img image.Image, format string) error {
+	switch format {
+	case "jpeg":
+		return jpeg.Encode(w, img, &jpeg.Options{Quality: 90})
+	case "png":
+		return png.Encode(w, img)
+	}
+	return fmt.Errorf("unsupported image format %s", format)
+}
+
+// saveImage writes the given image to the given path in the given format.
+func saveImage(path string, img image.Image, format string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := encodeImage(f, img, format); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bytes"
+	"github.com/machinebox/sdk-go/facebox"
+	"golang.org/x/image/bmp"
+	"golang.org/x/image/tiff"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeOrientedJPEG writes a 40x20 JPEG picture to the given path whose left half is red
+// and right half is blue, with the given EXIF orientation.
+func writeOrientedJPEG(t *testing.T, path string, orientation byte) {
+	img := image.NewRGBA(image.Rect(0, 0, 40, 20))
+	for y := 0; y < 20; y++ {
+		for x := 0; x < 40; x++ {
+			if x < 20 {
+				img.Set(x, y, color.RGBA{R: 255, A: 255})
+			} else {
+				img.Set(x, y, color.RGBA{B: 255, A: 255})
+			}
+		}
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 100}); err != nil {
+		t.Fatal(err)
+	}
+
+	// An APP1 segment with a big endian TIFF structure with one IFD with the orientation tag.
+	exif := []byte("Exif\x00\x00MM\x00\x2a\x00\x00\x00\x08\x00\x01\x01\x12\x00\x03\x00\x00\x00\x01\x00\x00\x00\x00\x00\x00\x00\x00")
+	exif[6+8+2+8+1] = orientation
+	app1 := append([]byte{0xFF, 0xE1, 0x00, byte(len(exif) + 2)}, exif...)
+
+	b := buf.Bytes()
+	b = append(append(append([]byte{}, b[:2]...), app1...), b[2:]...)
+	if err := ioutil.WriteFile(path, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func isRed(c color.Color) bool {
+	r, g, b, _ := c.RGBA()
+	return r > 0xC000 && g < 0x4000 && b < 0x4000
+}
+
+func Test_loadPicture_cropFace_with_orientation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "coalescer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "rotated.jpg")
+	writeOrientedJPEG(t, path, 6)
+
+	pic, err := loadPicture(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pic.orientation != 6 {
+		t.Fatalf("expected orientation 6; got %d", pic.orientation)
+	}
+
+	// The rect is in the coordinates of the stored pixels, but the crop should be upright.
+	crop := pic.cropFace(facebox.Rect{Top: 0, Left: 0, Width: 40, Height: 20}, 0)
+	if crop.Bounds().Dx() != 20 || crop.Bounds().Dy() != 40 {
+		t.Fatalf("expected an upright crop of 20x40; got %v", crop.Bounds())
+	}
+	// Rotating the picture 90 degrees clockwise moves its red left half to the top.
+	if !isRed(crop.At(10, 5)) || isRed(crop.At(10, 35)) {
+		t.Errorf("expected the top half of the crop to be red and the bottom half not to be")
+	}
+}
+
+func Test_resizeToFit(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 400, 200))
+	resized := resizeToFit(img, 100)
+	if resized.Bounds().Dx() != 100 || resized.Bounds().Dy() != 50 {
+		t.Errorf("expected a 100x50 image; got %v", resized.Bounds())
+	}
+	if resizeToFit(img, 0) != img {
+		t.Errorf("resizeToFit shouldn't resize the image when the size is 0")
+	}
+}
+
+func Test_copyFaceCrops(t *testing.T) {
+	dir, err := ioutil.TempDir("", "coalescer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c, err := newConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.People = PeopleToIdentify{"bill": nil, "mark": nil}
+	c.Confidence = 0.5
+	c.CropSize = 64
+	c.CropFormat = "png"
+	c.WorkingDir = dir
+	for _, d := range []string{"bill", "mark"} {
+		if err := os.Mkdir(filepath.Join(dir, d), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	b, err := ioutil.ReadFile("pics_dir/mark_and_bill.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "mark_and_bill.jpg"), b, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	faces := []facebox.Face{
+		{Rect: facebox.Rect{Top: 100, Left: 100, Width: 200, Height: 200}, Name: "bill", Matched: true, Confidence: 0.7},
+		{Rect: facebox.Rect{Top: 100, Left: 600, Width: 200, Height: 200}, Name: "mark", Matched: true, Confidence: 0.7},
+		{Rect: facebox.Rect{Top: 400, Left: 600, Width: 200, Height: 200}},
+	}
+	pic, err := loadPicture(filepath.Join(dir, "mark_and_bill.jpg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := copyFaceCrops(c, pic, "mark_and_bill", faces, []string{"bill", "mark"}); err != nil {
+		t.Fatalf("copyFaceCrops shouldn't fail; got error %s", err)
+	}
+
+	crops := map[string]string{
+		"bill": "mark_and_bill_face1.png",
+		"mark": "mark_and_bill_face2.png",
+	}
+	for folder, crop := range crops {
+		f, err := os.Open(filepath.Join(dir, folder, crop))
+		if err != nil {
+			t.Fatalf("face crop %s should exist in path %s", crop, folder)
+		}
+		cfg, _, err := image.DecodeConfig(f)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cfg.Width != 64 || cfg.Height != 64 {
+			t.Errorf("expected face crop %s to be 64x64; got %dx%d", crop, cfg.Width, cfg.Height)
+		}
+	}
+	for _, crop := range []string{"bill/mark_and_bill_face2.png", "mark/mark_and_bill_face1.png", "bill/mark_and_bill_face3.png"} {
+		if _, err := os.Stat(filepath.Join(dir, crop)); err == nil {
+			t.Errorf("face crop %s shouldn't exist", crop)
+		}
+	}
+}
+
+func Test_parseFormats(t *testing.T) {
+	formats, err := parseFormats("JPG, png,tif,webp")
+	if err != nil {
+		t.Fatalf("parseFormats shouldn't fail; got error %s", err)
+	}
+	want := []string{"jpeg", "png", "tiff", "webp"}
+	if strings.Join(formats, ",") != strings.Join(want, ",") {
+		t.Errorf("expected formats %v; got %v", want, formats)
+	}
+
+	if _, err := parseFormats("jpeg,heic"); err == nil {
+		t.Errorf("parseFormats should fail with an unsupported format")
+	}
+}
+
+func Test_recognizeAndCopy_converts_other_formats(t *testing.T) {
+	dir, err := ioutil.TempDir("", "coalescer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	img := image.NewRGBA(image.Rect(0, 0, 40, 20))
+	encoders := map[string]func(io.Writer, image.Image) error{
+		"scan.tiff": func(w io.Writer, m image.Image) error { return tiff.Encode(w, m, nil) },
+		"scan.bmp":  bmp.Encode,
+		"anim.gif":  func(w io.Writer, m image.Image) error { return gif.Encode(w, m, nil) },
+	}
+	for name, encode := range encoders {
+		f, err := os.Create(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := encode(f, img); err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+	}
+
+	c, err := newConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.WorkingDir = dir
+	c.People = PeopleToIdentify{"bill": nil}
+	c.Confidence = 0.5
+	c.AllowedFormats = []string{"jpeg", "png", "tiff", "bmp"}
+	if err := os.Mkdir(filepath.Join(dir, "bill"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	originalFacebox := fbox
+	fbox = &checkFuncRecognizer{check: func(r io.Reader) ([]facebox.Face, error) {
+		_, format, err := image.DecodeConfig(r)
+		if err != nil {
+			return nil, err
+		}
+		if !recognizerAccepts(format) {
+			t.Errorf("facebox shouldn't receive pictures of type %s", format)
+		}
+		return []facebox.Face{{Name: "bill", Matched: true, Confidence: 0.7}}, nil
+	}}
+	defer func(original recognizer) {
+		fbox = original
+	}(originalFacebox)
+
+	for _, name := range []string{"scan.tiff", "scan.bmp"} {
+		if re := recognizeAndCopy(c, name); re.err != nil {
+			t.Errorf("recognizeAndCopy shouldn't fail with %s; got error %s", name, re.err)
+		}
+		// The original picture should be copied untouched.
+		original, _ := ioutil.ReadFile(filepath.Join(dir, name))
+		copied, err := ioutil.ReadFile(filepath.Join(dir, "bill", name))
+		if err != nil || !bytes.Equal(original, copied) {
+			t.Errorf("picture %s should be copied untouched to bill", name)
+		}
+	}
+
+	// gif is not one of the allowed formats.
+	if re := recognizeAndCopy(c, "anim.gif"); re.skipped == "" {
+		t.Errorf("recognizeAndCopy should skip a format that is not allowed")
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/machinebox/sdk-go/facebox"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+)
+
+// resultIndex represents the faces found in each picture of a run. Since each face carries
+// its faceprint, the pictures can be re-evaluated later, e.g. with a different set of people,
+// confidence or match rules, without uploading the pictures to facebox again.
+type resultIndex struct {
+	Pictures []indexEntry `json:"pictures"`
+}
+
+// indexEntry represents the result of recognizing people in a single picture.
+type indexEntry struct {
+	Path         string         `json:"path"`
+	Faces        []facebox.Face `json:"faces"`
+	Destinations []string       `json:"destinations,omitempty"`
+	Error        string         `json:"error,omitempty"`
+
+	// ErrorKind is the kind of Error, see errorKind.
+	ErrorKind string `json:"error_kind,omitempty"`
+
+	// Frame is the index of the frame the faces were found in, and Frames maps each destination
+	// to the index of the first frame that matched it. They're only set for pictures with
+	// several frames.
+	Frame  int            `json:"frame,omitempty"`
+	Frames map[string]int `json:"frames,omitempty"`
+
+	// Folders maps each destination whose copy was moved to a subfolder to that subfolder,
+	// e.g. bill/similar_01. See handleNearDuplicates.
+	Folders map[string]string `json:"folders,omitempty"`
+
+	// DuplicateOf is the path of the picture with the same content that was checked instead.
+	DuplicateOf string `json:"duplicate_of,omitempty"`
+}
+
+// newResultIndex creates a resultIndex with the given results.
+func newResultIndex(results []result) *resultIndex {
+	idx := &resultIndex{Pictures: make([]indexEntry, 0, len(results))}
+	for _, re := range results {
+		entry := indexEntry{
+			Path:         re.path,
+			Faces:        re.faces,
+			Destinations: re.destinations,
+			Frame:        re.frame,
+			Frames:       re.frames,
+			Folders:      re.folders,
+			DuplicateOf:  re.duplicateOf,
+		}
+		if re.err != nil {
+			entry.Error = re.err.Error()
+			entry.ErrorKind = errorKind(re.err)
+		}
+		idx.Pictures = append(idx.Pictures, entry)
+	}
+	return idx
+}
+
+// loadResultIndex reads the result index stored in the given path.
+func loadResultIndex(path string) (*resultIndex, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	idx := &resultIndex{}
+	if err := json.Unmarshal(b, idx); err != nil {
+		return nil, fmt.Errorf("couldn't read the result index %s; got error %s", path, err)
+	}
+	return idx, nil
+}
+
+// save writes the result index to the given path.
+func (idx *resultIndex) save(path string) error {
+	b, err := json.MarshalIndent(idx, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// noMatch tells whether the picture of the entry didn't match anyone in the original run.
+// The indexes written before the error kinds existed only have the error message.
+func (entry indexEntry) noMatch() bool {
+	if entry.ErrorKind != "" {
+		return entry.ErrorKind == errorKindNoMatch
+	}
+	return strings.HasPrefix(entry.Error, errNoMatch.Error()) || strings.HasPrefix(entry.Error, errNoRigidMatch.Error())
+}
+
+// indexedError is the error a picture got in the original run, as stored in the result index.
+// It keeps the message and the kind of the original error, so re-evaluating the same index
+// several times doesn't change them.
+type indexedError struct {
+	msg  string
+	kind string
+}
+
+func (e indexedError) Error() string {
+	return e.msg
+}
+
+// reevaluatePictures starts a goroutine that re-evaluates each picture in the result index
+// defined in config.IndexPath. Instead of uploading the pictures again, it checks the stored
+// faceprints of each picture against the people facebox knows now. The results of each picture
+// are sent on the result channel and any error reading the index on the error channel.
+func reevaluatePictures(c *config, done <-chan struct{}) (<-chan result, <-chan error) {
+	ch := make(chan result)
+	errc := make(chan error, 1)
+	go func() {
+		defer close(ch)
+		idx, err := loadResultIndex(c.IndexPath)
+		if err != nil {
+			errc <- err
+			return
+		}
+		for _, entry := range idx.Pictures {
+			start := time.Now()
+			re := reevaluateAndCopy(c, entry)
+			re.duration = time.Since(start)
+			select {
+			case ch <- re:
+			case <-done:
+				errc <- errors.New("re-evaluation canceled")
+				return
+			}
+		}
+		errc <- nil
+	}()
+	return ch, errc
+}
+
+// reevaluateAndCopy re-evaluates the faces of a picture from the result index. If it
+// succeeds to recognize people, the picture will be copied to their folders.
+func reevaluateAndCopy(c *config, entry indexEntry) (re result) {
+	re.path = entry.Path
+	if entry.DuplicateOf != "" {
+		re.duplicateOf = entry.DuplicateOf
+		return
+	}
+	// Pictures that didn't match anyone are re-evaluated like the rest, since the people we
+	// want to recognize might have changed.
+	if len(entry.Faces) == 0 && entry.Error != "" && !entry.noMatch() {
+		re.err = indexedError{msg: entry.Error, kind: entry.ErrorKind}
+		if entry.ErrorKind == "" {
+			re.err = indexedError{msg: entry.Error, kind: errorKindOther}
+		}
+		return
+	}
+
+	faceprints := make([]string, 0, len(entry.Faces))
+	for _, face := range entry.Faces {
+		if face.Faceprint == "" {
+			re.err = fmt.Errorf("the picture has faces without faceprints in the result index")
+			return
+		}
+		faceprints = append(faceprints, face.Faceprint)
+	}
+
+	if len(faceprints) > 0 {
+		faces, err := fbox.CheckFaceprints(faceprints)
+		if err != nil {
+			re.err = err
+			return
+		}
+		if len(faces) != len(entry.Faces) {
+			re.err = fmt.Errorf("expected facebox to check %d faceprints; got %d", len(entry.Faces), len(faces))
+			return
+		}
+		// facebox only tells us who each faceprint belongs to, so we keep the rest of the
+		// information we stored about each face.
+		for i := range faces {
+			faces[i].Rect = entry.Faces[i].Rect
+			faces[i].Faceprint = entry.Faces[i].Faceprint
+		}
+		re.faces = faces
+	}
+
+	// Only the faces of a single frame are kept in the index, so pictures with several frames
+	// are re-evaluated against that frame.
+	re.frame = entry.Frame
+	re.destinations, re.err = classifyAndCopy(c, entry.Path, entry.Frame, re.faces)
+	if entry.Frames != nil && re.err == nil {
+		re.frames = make(map[string]int)
+		for _, dest := range re.destinations {
+			re.frames[dest] = entry.Frame
+		}
+	}
+	return
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"github.com/machinebox/sdk-go/facebox"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func Test_run_with_index_and_reevaluate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "coalescer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	indexPath := filepath.Join(dir, "index.json")
+	manifestPath := filepath.Join(dir, "manifest.json")
+
+	originalFacebox := fbox
+	fbox = &mockRecognizer{}
+	defer func(original recognizer) {
+		fbox = original
+	}(originalFacebox)
+
+	// Let's clean the directory after testing.
+	defer func() {
+		for _, d := range []string{"bill", "mark", "bill_mark"} {
+			if err := os.RemoveAll(d); err != nil {
+				t.Log(err)
+			}
+		}
+	}()
+
+	conf, output, err := parseFlags("coalescer", []string{"-faceboxurl=http://localhost:8080",
+		"-peopledir=people_dir", "-picsdir=pics_dir", "-index=" + indexPath, "-manifest=" + manifestPath})
+	if err != nil {
+		t.Fatalf("got error (%s) while using parseFlags. Output was: %s", err, output)
+	}
+	if err := conf.Validate(); err != nil {
+		t.Fatalf("conf.Validate() should be valid got error: %s", err)
+	}
+	if err := run(conf); err != nil {
+		t.Fatalf("run shouldn't fail; got this err %s", err)
+	}
+
+	idx, err := loadResultIndex(indexPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(idx.Pictures) != 2 {
+		t.Fatalf("expected 2 pictures in the result index; got %d", len(idx.Pictures))
+	}
+	for _, entry := range idx.Pictures {
+		if len(entry.Faces) == 0 {
+			t.Errorf("expected faces for picture %s in the result index", entry.Path)
+		}
+		for _, face := range entry.Faces {
+			if face.Faceprint == "" {
+				t.Errorf("expected faceprints for picture %s in the result index", entry.Path)
+			}
+		}
+	}
+
+	// Now let's re-evaluate the previous run but combining bill and mark.
+	conf, output, err = parseFlags("coalescer", []string{"-faceboxurl=http://localhost:8080",
+		"-peopledir=people_dir", "-combine=bill,mark", "-reevaluate", "-index=" + indexPath, "-manifest=" + manifestPath})
+	if err != nil {
+		t.Fatalf("got error (%s) while using parseFlags. Output was: %s", err, output)
+	}
+	if err := conf.Validate(); err != nil {
+		t.Fatalf("conf.Validate() should be valid got error: %s", err)
+	}
+
+	// The pictures shouldn't be uploaded to facebox again.
+	fbox = &checkFuncRecognizer{check: func(image io.Reader) ([]facebox.Face, error) {
+		b, err := ioutil.ReadAll(image)
+		if err != nil {
+			return nil, err
+		}
+		if pic := testFilesMapSha[fmt.Sprintf("%x", sha1.Sum(b))]; pic == "bill_and_steve.jpg" || pic == "mark_and_bill.jpg" {
+			t.Errorf("pictures from picsdir shouldn't be checked when re-evaluating")
+		}
+		return (&mockRecognizer{}).Check(bytes.NewReader(b))
+	}}
+	if err := run(conf); err != nil {
+		t.Fatalf("run shouldn't fail; got this err %s", err)
+	}
+
+	if _, err := os.Stat(filepath.Join("bill_mark", "mark_and_bill.jpg")); os.IsNotExist(err) {
+		t.Errorf("picture mark_and_bill.jpg should exist in path bill_mark")
+	}
+	if _, err := os.Stat(filepath.Join("bill_mark", "bill_and_steve.jpg")); err == nil {
+		t.Errorf("picture bill_and_steve.jpg shouldn't exist in path bill_mark")
+	}
+}
+
+func Test_reevaluateAndCopy_without_faces(t *testing.T) {
+	c, err := newConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.WorkingDir = ""
+	c.People = PeopleToIdentify{"bill": nil, "mark": nil}
+	c.Confidence = 0.5
+
+	originalFacebox := fbox
+	fbox = &mockRecognizer{}
+	defer func(original recognizer) {
+		fbox = original
+	}(originalFacebox)
+
+	scenarios := []struct {
+		desc  string
+		entry indexEntry
+		kind  string
+	}{
+		{
+			desc:  "a picture without faces",
+			entry: indexEntry{Path: "pics_dir/landscape.jpg", Error: "there is no match with a confidence 0.50", ErrorKind: errorKindNoMatch},
+			kind:  errorKindNoMatch,
+		},
+		{
+			desc:  "a picture without faces from an index without error kinds",
+			entry: indexEntry{Path: "pics_dir/landscape.jpg", Error: "there is no match with a confidence 0.50"},
+			kind:  errorKindNoMatch,
+		},
+		{
+			desc:  "a picture that couldn't be decoded",
+			entry: indexEntry{Path: "pics_dir/broken.jpg", Error: "image: unknown format", ErrorKind: errorKindDecode},
+			kind:  errorKindDecode,
+		},
+		{
+			desc:  "a picture that couldn't be decoded from an index without error kinds",
+			entry: indexEntry{Path: "pics_dir/broken.jpg", Error: "image: unknown format"},
+			kind:  errorKindOther,
+		},
+	}
+	for _, s := range scenarios {
+		re := reevaluateAndCopy(c, s.entry)
+		if got := errorKind(re.err); got != s.kind {
+			t.Errorf("expected the error kind %s when re-evaluating %s; got %s (%v)", s.kind, s.desc, got, re.err)
+		}
+	}
+
+	summary := newRunSummary(c)
+	summary.add(reevaluateAndCopy(c, scenarios[0].entry))
+	if summary.failed != 0 || summary.noMatch != 1 {
+		t.Errorf("a picture without faces shouldn't be a failure; got %d failed and %d without a match", summary.failed, summary.noMatch)
+	}
+}
+
+func Test_reevaluateAndCopy_twice(t *testing.T) {
+	c, err := newConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.WorkingDir = ""
+	c.People = PeopleToIdentify{"bill": nil, "mark": nil}
+	c.Confidence = 0.5
+
+	originalFacebox := fbox
+	fbox = &mockRecognizer{}
+	defer func(original recognizer) {
+		fbox = original
+	}(originalFacebox)
+
+	entry := indexEntry{Path: "pics_dir/broken.jpg", Error: "open pics_dir/broken.jpg: permission denied", ErrorKind: errorKindIO}
+	idx := &resultIndex{Pictures: []indexEntry{entry}}
+	for i := 0; i < 2; i++ {
+		idx = newResultIndex([]result{reevaluateAndCopy(c, idx.Pictures[0])})
+	}
+	if got := idx.Pictures[0]; got.Error != entry.Error || got.ErrorKind != entry.ErrorKind {
+		t.Errorf("expected the original error %q of kind %s to be kept; got %q of kind %s", entry.Error, entry.ErrorKind, got.Error, got.ErrorKind)
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// logLevel represents how important a log entry is.
+type logLevel int
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+// logLevelNames maps the log levels to their names, which are also the values the
+// log-level flag accepts.
+var logLevelNames = map[logLevel]string{
+	levelDebug: "debug",
+	levelInfo:  "info",
+	levelWarn:  "warn",
+	levelError: "error",
+}
+
+func (l logLevel) String() string {
+	return logLevelNames[l]
+}
+
+// parseLogLevel returns the log level with the given name.
+func parseLogLevel(name string) (logLevel, error) {
+	for l, n := range logLevelNames {
+		if strings.EqualFold(n, name) {
+			return l, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level %q", name)
+}
+
+// The formats of the log entries.
+const (
+	logFormatText = "text"
+	logFormatJSON = "json"
+)
+
+// logField represents a key and a value attached to a log entry, e.g. the path of the
+// picture the entry is about.
+type logField struct {
+	key   string
+	value interface{}
+}
+
+// field returns a logField with the given key and value.
+func field(key string, value interface{}) logField {
+	return logField{key: key, value: value}
+}
+
+// logger writes levelled log entries with fields, either as text lines like
+//
+//	2020-06-18T11:52:03Z INFO Success to recognize people path=pics/bill.jpg faces=1
+//
+// or as one JSON object per line, so they can be shipped to a log aggregator. It's safe to
+// use a logger from several goroutines.
+type logger struct {
+	mu     sync.Mutex
+	w      io.Writer
+	level  logLevel
+	format string
+	now    func() time.Time
+}
+
+// newLogger creates a logger that writes the entries with the given level or above to w
+// in the given format.
+func newLogger(w io.Writer, level logLevel, format string) *logger {
+	return &logger{w: w, level: level, format: format, now: time.Now}
+}
+
+// setUpLogger replaces _logger with a logger configured with the log flags. The returned
+// function closes the log file, if any.
+func setUpLogger(c *config) (func() error, error) {
+	level, err := parseLogLevel(c.LogLevel)
+	if err != nil {
+		return nil, err
+	}
+	if c.LogFile == "" {
+		_logger = newLogger(os.Stderr, level, c.LogFormat)
+		return func() error { return nil }, nil
+	}
+	f, err := os.OpenFile(c.LogFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		return nil, err
+	}
+	_logger = newLogger(f, level, c.LogFormat)
+	return f.Close, nil
+}
+
+func (l *logger) Debug(msg string, fields ...logField) {
+	l.log(levelDebug, msg, fields)
+}
+
+func (l *logger) Info(msg string, fields ...logField) {
+	l.log(levelInfo, msg, fields)
+}
+
+func (l *logger) Warn(msg string, fields ...logField) {
+	l.log(levelWarn, msg, fields)
+}
+
+func (l *logger) Error(msg string, fields ...logField) {
+	l.log(levelError, msg, fields)
+}
+
+func (l *logger) log(level logLevel, msg string, fields []logField) {
+	if level < l.level {
+		return
+	}
+	var buf bytes.Buffer
+	t := l.now().UTC().Format(time.RFC3339)
+	if l.format == logFormatJSON {
+		buf.WriteString(`{"time":`)
+		writeJSONValue(&buf, t)
+		buf.WriteString(`,"level":`)
+		writeJSONValue(&buf, level.String())
+		buf.WriteString(`,"msg":`)
+		writeJSONValue(&buf, msg)
+		for _, f := range fields {
+			buf.WriteByte(',')
+			writeJSONValue(&buf, f.key)
+			buf.WriteByte(':')
+			writeJSONValue(&buf, logValue(f.value))
+		}
+		buf.WriteString("}\n")
+	} else {
+		fmt.Fprintf(&buf, "%s %s %s", t, strings.ToUpper(level.String()), msg)
+		for _, f := range fields {
+			v := fmt.Sprint(logValue(f.value))
+			if v == "" || strings.ContainsAny(v, " \t\n\"=") {
+				v = strconv.Quote(v)
+			}
+			fmt.Fprintf(&buf, " %s=%s", f.key, v)
+		}
+		buf.WriteByte('\n')
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.w.Write(buf.Bytes())
+}
+
+// logValue returns the given value of a field in a form that reads well in both formats.
+func logValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case error:
+		return v.Error()
+	case time.Duration:
+		return v.String()
+	case fmt.Stringer:
+		return v.String()
+	}
+	return v
+}
+
+// writeJSONValue writes the given value as JSON, or its string form if it cannot be encoded.
+func writeJSONValue(buf *bytes.Buffer, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		b, _ = json.Marshal(fmt.Sprint(v))
+	}
+	buf.Write(b)
+}
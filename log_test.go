@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestLogger(level logLevel, format string) (*logger, *bytes.Buffer) {
+	var buf bytes.Buffer
+	l := newLogger(&buf, level, format)
+	l.now = func() time.Time {
+		return time.Date(2020, 6, 18, 11, 52, 3, 0, time.UTC)
+	}
+	return l, &buf
+}
+
+func TestLogger_text(t *testing.T) {
+	l, buf := newTestLogger(levelInfo, logFormatText)
+	l.Debug("Skipped file", field("path", "pics/.DS_Store"))
+	l.Info("Success to recognize people", field("path", "pics/bill and steve.jpg"), field("worker", 3),
+		field("duration", 1500*time.Millisecond), field("faces", 2))
+	l.Error("Failed to recognize people", field("error", errors.New("boom")))
+
+	want := "2020-06-18T11:52:03Z INFO Success to recognize people path=\"pics/bill and steve.jpg\" worker=3 duration=1.5s faces=2\n" +
+		"2020-06-18T11:52:03Z ERROR Failed to recognize people error=boom\n"
+	if buf.String() != want {
+		t.Errorf("expected the log\n%s\ngot\n%s", want, buf.String())
+	}
+}
+
+func TestLogger_json(t *testing.T) {
+	l, buf := newTestLogger(levelDebug, logFormatJSON)
+	l.Warn("Failed to recognize people", field("path", "pics/bill.jpg"), field("faces", 1),
+		field("error", fmt.Errorf("there is no match")))
+
+	want := `{"time":"2020-06-18T11:52:03Z","level":"warn","msg":"Failed to recognize people","path":"pics/bill.jpg","faces":1,"error":"there is no match"}` + "\n"
+	if buf.String() != want {
+		t.Errorf("expected the log\n%s\ngot\n%s", want, buf.String())
+	}
+	var entry map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Errorf("each entry should be valid JSON; got error %s", err)
+	}
+}
+
+func Test_parseLogLevel(t *testing.T) {
+	for name, want := range map[string]logLevel{"debug": levelDebug, "INFO": levelInfo, "warn": levelWarn, "error": levelError} {
+		got, err := parseLogLevel(name)
+		if err != nil || got != want {
+			t.Errorf("expected %s to be the level %s; got %s and error %v", name, want, got, err)
+		}
+	}
+	if _, err := parseLogLevel("verbose"); err == nil {
+		t.Errorf("parseLogLevel should fail with an unknown level")
+	}
+}
+
+func Test_errorKind(t *testing.T) {
+	_, statErr := os.Open("does_not_exist.jpg")
+	scenarios := []struct {
+		err  error
+		kind string
+	}{
+		{fmt.Errorf("%w with a confidence 0.50", errNoMatch), errorKindNoMatch},
+		{fmt.Errorf("%w in any of the 3 sampled frames with a confidence 0.50", errNoRigidMatch), errorKindNoMatch},
+		{fmt.Errorf("we couldn't check the frame 2; got error %w", recognizerError{errors.New("connection refused")}), errorKindRecognizer},
+		{image.ErrFormat, errorKindDecode},
+		{statErr, errorKindIO},
+		{errors.New("something else"), errorKindOther},
+	}
+	for _, s := range scenarios {
+		if got := errorKind(s.err); got != s.kind {
+			t.Errorf("expected the kind of %q to be %s; got %s", s.err, s.kind, got)
+		}
+	}
+}
+
+func Test_setUpLogger(t *testing.T) {
+	f, err := ioutil.TempFile("", "coalescer.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+
+	original := _logger
+	defer func() {
+		_logger = original
+	}()
+
+	c, err := newConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.LogFile = f.Name()
+	c.LogFormat = logFormatJSON
+	closeLog, err := setUpLogger(c)
+	if err != nil {
+		t.Fatalf("setUpLogger shouldn't fail; got error %s", err)
+	}
+	_logger.Info("hello", field("path", "pics/bill.jpg"))
+	if err := closeLog(); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := ioutil.ReadFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), `"msg":"hello","path":"pics/bill.jpg"`) {
+		t.Errorf("expected the entry in the log file; got %s", b)
+	}
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/machinebox/sdk-go/facebox"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// metric is a counter, gauge or histogram that can write itself in the Prometheus text format.
+type metric interface {
+	write(w io.Writer)
+}
+
+// counterVec represents a counter, or a gauge, with an optional label, e.g. the number of
+// pictures matched per person. It's safe to use a counterVec from several goroutines.
+type counterVec struct {
+	mu     sync.Mutex
+	name   string
+	help   string
+	kind   string
+	label  string
+	values map[string]float64
+}
+
+func newCounter(name, help, label string) *counterVec {
+	return &counterVec{name: name, help: help, kind: "counter", label: label, values: make(map[string]float64)}
+}
+
+func newGauge(name, help string) *counterVec {
+	return &counterVec{name: name, help: help, kind: "gauge", values: make(map[string]float64)}
+}
+
+// add adds the given value to the series with the given label value. Metrics without a
+// label have a single series, whose label value is "".
+func (c *counterVec) add(labelValue string, v float64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.values[labelValue] += v
+}
+
+func (c *counterVec) inc(labelValue string) {
+	c.add(labelValue, 1)
+}
+
+func (c *counterVec) write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", c.name, c.help, c.name, c.kind)
+	if c.label == "" {
+		fmt.Fprintf(w, "%s %s\n", c.name, formatMetricValue(c.values[""]))
+		return
+	}
+	for _, lv := range sortedMetricLabels(c.values) {
+		fmt.Fprintf(w, "%s{%s} %s\n", c.name, formatMetricLabel(c.label, lv), formatMetricValue(c.values[lv]))
+	}
+}
+
+// histogramVec represents a histogram with a label, e.g. the latency of the calls to facebox
+// per method. It's safe to use a histogramVec from several goroutines.
+type histogramVec struct {
+	mu      sync.Mutex
+	name    string
+	help    string
+	label   string
+	buckets []float64
+	series  map[string]*histogramSeries
+}
+
+// histogramSeries holds the observations of a histogramVec with a label value. counts[i]
+// is the number of observations that fall in buckets[i], or above the last bucket.
+type histogramSeries struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func newHistogram(name, help, label string, buckets []float64) *histogramVec {
+	return &histogramVec{name: name, help: help, label: label, buckets: buckets, series: make(map[string]*histogramSeries)}
+}
+
+func (h *histogramVec) observe(labelValue string, v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s, ok := h.series[labelValue]
+	if !ok {
+		s = &histogramSeries{counts: make([]uint64, len(h.buckets)+1)}
+		h.series[labelValue] = s
+	}
+	i := sort.SearchFloat64s(h.buckets, v)
+	s.counts[i]++
+	s.sum += v
+	s.count++
+}
+
+func (h *histogramVec) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	labelValues := make([]string, 0, len(h.series))
+	for lv := range h.series {
+		labelValues = append(labelValues, lv)
+	}
+	sort.Strings(labelValues)
+	for _, lv := range labelValues {
+		s := h.series[lv]
+		label := formatMetricLabel(h.label, lv)
+		var cumulative uint64
+		for i, le := range h.buckets {
+			cumulative += s.counts[i]
+			fmt.Fprintf(w, "%s_bucket{%s,le=\"%s\"} %d\n", h.name, label, formatMetricValue(le), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket{%s,le=\"+Inf\"} %d\n", h.name, label, s.count)
+		fmt.Fprintf(w, "%s_sum{%s} %s\n", h.name, label, formatMetricValue(s.sum))
+		fmt.Fprintf(w, "%s_count{%s} %d\n", h.name, label, s.count)
+	}
+}
+
+func formatMetricValue(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func formatMetricLabel(name, value string) string {
+	value = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+	return fmt.Sprintf("%s=\"%s\"", name, value)
+}
+
+func sortedMetricLabels(values map[string]float64) []string {
+	labels := make([]string, 0, len(values))
+	for lv := range values {
+		labels = append(labels, lv)
+	}
+	sort.Strings(labels)
+	return labels
+}
+
+// coalescerMetrics holds the metrics coalescer exposes while it runs, see serveMetrics.
+type coalescerMetrics struct {
+	filesDiscovered *counterVec
+	filesProcessed  *counterVec
+	filesMatched    *counterVec
+	filesNoMatch    *counterVec
+	filesFailed     *counterVec
+	bytesCopied     *counterVec
+	workersInFlight *counterVec
+	recognizerCalls *histogramVec
+	all             []metric
+}
+
+func newCoalescerMetrics() *coalescerMetrics {
+	m := &coalescerMetrics{
+		filesDiscovered: newCounter("coalescer_files_discovered_total", "Number of files found in picsdir and the list of files.", ""),
+		filesProcessed:  newCounter("coalescer_files_processed_total", "Number of files checked.", ""),
+		filesMatched:    newCounter("coalescer_files_matched_total", "Number of pictures matched per destination folder.", "person"),
+		filesNoMatch:    newCounter("coalescer_files_no_match_total", "Number of pictures that didn't match anyone.", ""),
+		filesFailed:     newCounter("coalescer_files_failed_total", "Number of files that failed per kind of error.", "kind"),
+		bytesCopied:     newCounter("coalescer_bytes_copied_total", "Number of bytes of the pictures and face crops stored.", ""),
+		workersInFlight: newGauge("coalescer_workers_in_flight", "Number of digesters checking a file right now."),
+		recognizerCalls: newHistogram("coalescer_recognizer_call_duration_seconds", "Latency of the calls to facebox per method.", "method",
+			[]float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}),
+	}
+	m.all = []metric{m.filesDiscovered, m.filesProcessed, m.filesMatched, m.filesNoMatch, m.filesFailed, m.bytesCopied, m.workersInFlight, m.recognizerCalls}
+	return m
+}
+
+// recordResult updates the metrics with the given result of a file. Like in runSummary, the
+// pictures that don't match anyone aren't counted as failures.
+func (m *coalescerMetrics) recordResult(re result) {
+	m.filesProcessed.inc("")
+	if re.err != nil {
+		if kind := errorKind(re.err); kind == errorKindNoMatch {
+			m.filesNoMatch.inc("")
+		} else {
+			m.filesFailed.inc(kind)
+		}
+	}
+	if re.err == nil && re.skipped == "" && re.duplicateOf == "" {
+		for _, dest := range re.destinations {
+			m.filesMatched.inc(dest)
+		}
+	}
+}
+
+// ServeHTTP writes the metrics in the Prometheus text format.
+func (m *coalescerMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var buf bytes.Buffer
+	for _, metric := range m.all {
+		metric.write(&buf)
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write(buf.Bytes())
+}
+
+// _metrics holds the metrics of this run. They are always recorded, but only exposed if
+// config.MetricsAddr is set.
+var _metrics = newCoalescerMetrics()
+
+// serveMetrics exposes _metrics on the /metrics path of the given address until the
+// returned function is called.
+func serveMetrics(addr string) (func() error, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", _metrics)
+	srv := &http.Server{Handler: mux}
+	go func() {
+		if err := srv.Serve(l); err != nil && err != http.ErrServerClosed {
+			_logger.Error("The metrics endpoint stopped", field("error", err))
+		}
+	}()
+	return srv.Close, nil
+}
+
+// instrumentedRecognizer is a recognizer that records the latency of the calls to Teach and
+// to the Check methods of the underlying recognizer.
+type instrumentedRecognizer struct {
+	recognizer
+}
+
+func (r instrumentedRecognizer) observe(method string, start time.Time) {
+	_metrics.recognizerCalls.observe(method, time.Since(start).Seconds())
+}
+
+func (r instrumentedRecognizer) Teach(image io.Reader, id string, name string) error {
+	defer r.observe("teach", time.Now())
+	return r.recognizer.Teach(image, id, name)
+}
+
+func (r instrumentedRecognizer) Check(image io.Reader) ([]facebox.Face, error) {
+	defer r.observe("check", time.Now())
+	return r.recognizer.Check(image)
+}
+
+func (r instrumentedRecognizer) CheckBase64WithFaceprint(data string) ([]facebox.Face, error) {
+	defer r.observe("check", time.Now())
+	return r.recognizer.CheckBase64WithFaceprint(data)
+}
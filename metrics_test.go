@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/machinebox/sdk-go/facebox"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCounterVec_write(t *testing.T) {
+	c := newCounter("coalescer_files_matched_total", "Number of pictures matched per destination folder.", "person")
+	c.inc("mark")
+	c.inc("bill")
+	c.add("bill", 2)
+
+	var buf bytes.Buffer
+	c.write(&buf)
+	want := `# HELP coalescer_files_matched_total Number of pictures matched per destination folder.
+# TYPE coalescer_files_matched_total counter
+coalescer_files_matched_total{person="bill"} 3
+coalescer_files_matched_total{person="mark"} 1
+`
+	if buf.String() != want {
+		t.Errorf("expected\n%s\ngot\n%s", want, buf.String())
+	}
+}
+
+func TestHistogramVec_write(t *testing.T) {
+	h := newHistogram("coalescer_recognizer_call_duration_seconds", "Latency of the calls to facebox per method.", "method", []float64{0.1, 1})
+	h.observe("check", 0.05)
+	h.observe("check", 0.5)
+	h.observe("check", 3)
+
+	var buf bytes.Buffer
+	h.write(&buf)
+	want := `# HELP coalescer_recognizer_call_duration_seconds Latency of the calls to facebox per method.
+# TYPE coalescer_recognizer_call_duration_seconds histogram
+coalescer_recognizer_call_duration_seconds_bucket{method="check",le="0.1"} 1
+coalescer_recognizer_call_duration_seconds_bucket{method="check",le="1"} 2
+coalescer_recognizer_call_duration_seconds_bucket{method="check",le="+Inf"} 3
+coalescer_recognizer_call_duration_seconds_sum{method="check"} 3.55
+coalescer_recognizer_call_duration_seconds_count{method="check"} 3
+`
+	if buf.String() != want {
+		t.Errorf("expected\n%s\ngot\n%s", want, buf.String())
+	}
+}
+
+func TestCoalescerMetrics_ServeHTTP(t *testing.T) {
+	original := _metrics
+	_metrics = newCoalescerMetrics()
+	defer func() {
+		_metrics = original
+	}()
+
+	_metrics.recordResult(result{path: "pics/mark_and_bill.jpg", destinations: []string{"bill", "mark"}})
+	_metrics.recordResult(result{path: "pics/bill_and_steve.jpg", err: fmt.Errorf("%w with a confidence 0.50", errNoMatch)})
+	_metrics.recordResult(result{path: "pics/bill.jpg", err: recognizerError{errors.New("connection refused")}})
+
+	r := instrumentedRecognizer{&checkFuncRecognizer{check: func(io.Reader) ([]facebox.Face, error) {
+		return nil, nil
+	}}}
+	if _, err := r.Check(strings.NewReader("picture")); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Teach(strings.NewReader("picture"), "bill_1.jpg", "bill"); err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	_metrics.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	body := w.Body.String()
+	for _, line := range []string{
+		"coalescer_files_processed_total 3",
+		`coalescer_files_matched_total{person="bill"} 1`,
+		`coalescer_files_matched_total{person="mark"} 1`,
+		"coalescer_files_no_match_total 1",
+		`coalescer_files_failed_total{kind="recognizer"} 1`,
+		`coalescer_recognizer_call_duration_seconds_count{method="check"} 1`,
+		`coalescer_recognizer_call_duration_seconds_count{method="teach"} 1`,
+		"coalescer_workers_in_flight 0",
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("expected the metrics to contain %q; got\n%s", line, body)
+		}
+	}
+	if strings.Contains(body, `kind="no_match"`) {
+		t.Errorf("expected the pictures without a match not to be counted as failures; got\n%s", body)
+	}
+}
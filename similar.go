@@ -0,0 +1,200 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math/bits"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// The ways coalescer can handle the near-duplicate pictures of each destination.
+const (
+	nearDuplicatesKeepBest = "keep-best"
+	nearDuplicatesGroup    = "group"
+)
+
+// dHash computes the difference hash of the given image: the image is shrunk to 9x8 gray
+// pixels and each bit of the hash tells whether a pixel is brighter than the pixel on its
+// right. Resized, recompressed or slightly different versions of the same picture, like
+// burst shots, have hashes that differ in a few bits only.
+func dHash(img image.Image) uint64 {
+	small := resize(img, 9, 8)
+	b := small.Bounds()
+	var hash uint64
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			left := color.GrayModel.Convert(small.At(b.Min.X+x, b.Min.Y+y)).(color.Gray).Y
+			right := color.GrayModel.Convert(small.At(b.Min.X+x+1, b.Min.Y+y)).(color.Gray).Y
+			hash <<= 1
+			if left > right {
+				hash |= 1
+			}
+		}
+	}
+	return hash
+}
+
+// hammingDistance returns the number of bits that differ between the given hashes.
+func hammingDistance(a, b uint64) int {
+	return bits.OnesCount64(a ^ b)
+}
+
+// similarPicture represents a picture copied to a destination, and its difference hash.
+type similarPicture struct {
+	name   string
+	hash   uint64
+	pixels int
+}
+
+// groupSimilarPictures groups the given pictures by their difference hashes. Each picture
+// joins the first group whose first picture is at most the given distance away from it;
+// otherwise the picture starts a new group.
+func groupSimilarPictures(pictures []similarPicture, distance int) [][]similarPicture {
+	var groups [][]similarPicture
+	for _, p := range pictures {
+		joined := false
+		for i, g := range groups {
+			if hammingDistance(g[0].hash, p.hash) <= distance {
+				groups[i] = append(groups[i], p)
+				joined = true
+				break
+			}
+		}
+		if !joined {
+			groups = append(groups, []similarPicture{p})
+		}
+	}
+	return groups
+}
+
+// handleNearDuplicates looks for near-duplicate pictures among the pictures copied to each
+// destination in the given results. Depending on config.NearDuplicates, it either keeps the
+// picture with the highest resolution of each group of near-duplicates and removes the rest,
+// or moves each group to its own subfolder of the destination, e.g. bill/similar_01/. The
+// results are updated to tell where their copies are now, see result.folders.
+func handleNearDuplicates(c *config, results []result) error {
+	// copied maps each destination to the names of the pictures copied to it, and each name
+	// to the position of its result.
+	copied := make(map[string]map[string]int)
+	for i, re := range results {
+		if re.err != nil {
+			continue
+		}
+		for _, dest := range re.destinations {
+			if copied[dest] == nil {
+				copied[dest] = make(map[string]int)
+			}
+			copied[dest][filepath.Base(re.path)] = i
+		}
+	}
+	dests := make([]string, 0, len(copied))
+	for dest := range copied {
+		dests = append(dests, dest)
+	}
+	sort.Strings(dests)
+
+	groupsFound := 0
+	for _, dest := range dests {
+		names := make([]string, 0, len(copied[dest]))
+		for name := range copied[dest] {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		var pictures []similarPicture
+		for _, name := range names {
+			pic, err := loadPicture(filepath.Join(c.WorkingDir, dest, name))
+			if err != nil {
+				// The picture might not have been copied, e.g. if we only store face crops.
+				if !os.IsNotExist(err) {
+					_logger.Warn("Couldn't look for near-duplicates", field("path", filepath.Join(dest, name)), field("error", err))
+				}
+				continue
+			}
+			b := pic.img.Bounds()
+			pictures = append(pictures, similarPicture{
+				name:   name,
+				hash:   dHash(applyOrientation(pic.img, pic.orientation)),
+				pixels: b.Dx() * b.Dy(),
+			})
+		}
+
+		// The groups are numbered per destination, so each destination starts at similar_01.
+		number := 0
+		for _, group := range groupSimilarPictures(pictures, c.NearDuplicateDistance) {
+			if len(group) < 2 {
+				continue
+			}
+			number++
+			groupsFound++
+			if err := handleNearDuplicateGroup(c, dest, group, number, results, copied[dest]); err != nil {
+				return err
+			}
+		}
+	}
+
+	if groupsFound > 0 {
+		fmt.Printf("Found %d groups of near-duplicate pictures.\n", groupsFound)
+	}
+	return nil
+}
+
+// handleNearDuplicateGroup keeps the best picture of the given group of near-duplicates in the
+// given destination, or moves the group to the subfolder with the given number. The results of
+// the pictures, found through the given map of names to positions, are updated accordingly:
+// the moved pictures record their subfolder and the removed ones lose the destination.
+func handleNearDuplicateGroup(c *config, dest string, group []similarPicture, number int, results []result, positions map[string]int) error {
+	folder := filepath.Join(c.WorkingDir, dest)
+	if c.NearDuplicates == nearDuplicatesGroup {
+		sub := fmt.Sprintf("similar_%02d", number)
+		if err := os.MkdirAll(filepath.Join(folder, sub), 0755); err != nil {
+			return err
+		}
+		for _, p := range group {
+			if err := os.Rename(filepath.Join(folder, p.name), filepath.Join(folder, sub, p.name)); err != nil {
+				return err
+			}
+			re := &results[positions[p.name]]
+			if re.folders == nil {
+				re.folders = make(map[string]string)
+			}
+			re.folders[dest] = filepath.ToSlash(filepath.Join(dest, sub))
+			_logger.Info("Moved a picture with its near-duplicates", field("path", filepath.Join(dest, p.name)), field("folder", filepath.Join(dest, sub)))
+		}
+		return nil
+	}
+
+	best := group[0]
+	for _, p := range group[1:] {
+		if p.pixels > best.pixels {
+			best = p
+		}
+	}
+	for _, p := range group {
+		if p.name == best.name {
+			continue
+		}
+		if err := os.Remove(filepath.Join(folder, p.name)); err != nil {
+			return err
+		}
+		re := &results[positions[p.name]]
+		re.destinations = removeString(re.destinations, dest)
+		delete(re.frames, dest)
+		_logger.Info("Removed a near-duplicate with a lower resolution", field("path", filepath.Join(dest, p.name)), field("kept", filepath.Join(dest, best.name)))
+	}
+	return nil
+}
+
+// removeString returns a copy of the given list without the given string.
+func removeString(list []string, s string) []string {
+	var kept []string
+	for _, e := range list {
+		if e != s {
+			kept = append(kept, e)
+		}
+	}
+	return kept
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// gradient returns an image with the given size whose brightness follows a pattern that
+// doesn't depend on the size, so its resized copies look the same.
+func gradient(w, h int, inverted bool) image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			// A few bright and dark stripes, so the hash has some bits set.
+			v := uint8((x * 4 * 255 / w) % 256)
+			if (y*3/h)%2 == 1 {
+				v = 255 - v
+			}
+			if inverted {
+				v = 255 - v
+			}
+			img.Set(x, y, color.RGBA{R: v, G: v, B: v, A: 255})
+		}
+	}
+	return img
+}
+
+func Test_dHash(t *testing.T) {
+	original := dHash(gradient(640, 480, false))
+	resized := dHash(gradient(320, 240, false))
+	different := dHash(gradient(640, 480, true))
+
+	if d := hammingDistance(original, resized); d > 4 {
+		t.Errorf("a resized copy should have a similar hash; got a distance of %d", d)
+	}
+	if d := hammingDistance(original, different); d < 20 {
+		t.Errorf("a different picture should have a different hash; got a distance of %d", d)
+	}
+}
+
+func Test_groupSimilarPictures(t *testing.T) {
+	pictures := []similarPicture{
+		{name: "a.jpg", hash: 0x0f},
+		{name: "b.jpg", hash: 0xf0f0},
+		{name: "c.jpg", hash: 0x1f},
+		{name: "d.jpg", hash: 0xf0f1},
+		{name: "e.jpg", hash: 0xffffffff},
+	}
+	groups := groupSimilarPictures(pictures, 2)
+	if len(groups) != 3 {
+		t.Fatalf("expected 3 groups; got %d", len(groups))
+	}
+	want := [][]string{{"a.jpg", "c.jpg"}, {"b.jpg", "d.jpg"}, {"e.jpg"}}
+	for i, g := range groups {
+		if len(g) != len(want[i]) {
+			t.Fatalf("expected group %d to be %v; got %v", i, want[i], g)
+		}
+		for j := range g {
+			if g[j].name != want[i][j] {
+				t.Errorf("expected group %d to be %v; got %v", i, want[i], g)
+			}
+		}
+	}
+}
+
+// setUpNearDuplicates creates two destination folders with two near-duplicate pictures and a
+// different one each, and returns the config and the results that copied them there.
+func setUpNearDuplicates(t *testing.T, mode string) (*config, []result) {
+	dir, err := ioutil.TempDir("", "coalescer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, dest := range []string{"bill", "mark"} {
+		if err := os.Mkdir(filepath.Join(dir, dest), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pictures := map[string]image.Image{
+		"burst_1.jpg": gradient(320, 240, false),
+		"burst_2.jpg": gradient(640, 480, false),
+		"beach.jpg":   gradient(640, 480, true),
+	}
+	var results []result
+	for name, img := range pictures {
+		for _, dest := range []string{"bill", "mark"} {
+			if err := saveImage(filepath.Join(dir, dest, name), img, "jpeg"); err != nil {
+				t.Fatal(err)
+			}
+		}
+		results = append(results, result{path: filepath.Join(dir, "pics", name), destinations: []string{"bill", "mark"}})
+	}
+
+	c, err := newConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.WorkingDir = dir
+	c.NearDuplicates = mode
+	return c, results
+}
+
+func Test_handleNearDuplicates_keep_best(t *testing.T) {
+	c, results := setUpNearDuplicates(t, nearDuplicatesKeepBest)
+	defer os.RemoveAll(c.WorkingDir)
+
+	if err := handleNearDuplicates(c, results); err != nil {
+		t.Fatalf("handleNearDuplicates shouldn't fail; got error %s", err)
+	}
+	if _, err := os.Stat(filepath.Join(c.WorkingDir, "bill", "burst_1.jpg")); !os.IsNotExist(err) {
+		t.Errorf("the near-duplicate with the lower resolution should be removed")
+	}
+	for _, name := range []string{"burst_2.jpg", "beach.jpg"} {
+		if _, err := os.Stat(filepath.Join(c.WorkingDir, "bill", name)); err != nil {
+			t.Errorf("%s should be kept; got error %s", name, err)
+		}
+	}
+	for _, re := range results {
+		if filepath.Base(re.path) == "burst_1.jpg" && len(re.destinations) != 0 {
+			t.Errorf("expected the removed near-duplicate to lose its destinations; got %v", re.destinations)
+		}
+	}
+}
+
+func Test_handleNearDuplicates_group(t *testing.T) {
+	c, results := setUpNearDuplicates(t, nearDuplicatesGroup)
+	defer os.RemoveAll(c.WorkingDir)
+
+	if err := handleNearDuplicates(c, results); err != nil {
+		t.Fatalf("handleNearDuplicates shouldn't fail; got error %s", err)
+	}
+	// The groups are numbered per destination.
+	for _, dest := range []string{"bill", "mark"} {
+		for _, name := range []string{"burst_1.jpg", "burst_2.jpg"} {
+			if _, err := os.Stat(filepath.Join(c.WorkingDir, dest, "similar_01", name)); err != nil {
+				t.Errorf("%s should be moved to the folder of its group in %s; got error %s", name, dest, err)
+			}
+		}
+	}
+	for _, re := range results {
+		want := "bill"
+		if filepath.Base(re.path) != "beach.jpg" {
+			want = "bill/similar_01"
+		}
+		if f := re.folder("bill"); f != want {
+			t.Errorf("expected the copy of %s to be in %s; got %s", re.path, want, f)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(c.WorkingDir, "bill", "beach.jpg")); err != nil {
+		t.Errorf("pictures without near-duplicates should stay where they are; got error %s", err)
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// sink represents where coalescer stores the pictures and face crops it sorts.
+type sink interface {
+	// put stores the content read from r as the file with the given name in the given folder.
+	// It's safe to call put from several goroutines.
+	put(folder, name string, r io.Reader) error
+
+	// close finishes storing the files. put cannot be called after close.
+	close() error
+}
+
+// output returns the sink where the sorted pictures should be stored. Unless there is an
+// output archive the pictures are stored in the folders inside config.WorkingDir.
+func (c *config) output() sink {
+	if c.Sink != nil {
+		return c.Sink
+	}
+	return folderSink{dir: c.WorkingDir}
+}
+
+// folderSink stores the files in the folders inside a directory.
+type folderSink struct {
+	dir string
+}
+
+func (s folderSink) put(folder, name string, r io.Reader) error {
+	f, err := os.Create(filepath.Join(s.dir, folder, name))
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(f, r)
+	_metrics.bytesCopied.add("", float64(n))
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (s folderSink) close() error {
+	return nil
+}
+
+// archiveEntry represents a file waiting to be written to an archive.
+type archiveEntry struct {
+	name string
+	data []byte
+}
+
+// archiveSink stores the files in a zip or tar archive, under the prefix of their folder, e.g.
+// bill/party.jpg. The digesters put the files concurrently, so a single goroutine writes them
+// to the archive one after another.
+type archiveSink struct {
+	path    string
+	entries chan archiveEntry
+	done    chan error
+}
+
+// archiveWriter is the common interface of the zip and tar writers.
+type archiveWriter interface {
+	add(name string, data []byte) error
+	io.Closer
+}
+
+// newArchiveSink creates an archiveSink that writes the archive to the given path. The type of
+// the archive depends on the extension of the path, see isArchive. The archive is written to a
+// temporary file that replaces the given path once the sink is closed.
+func newArchiveSink(archive string) (*archiveSink, error) {
+	f, err := os.Create(archive + ".tmp")
+	if err != nil {
+		return nil, err
+	}
+	var w archiveWriter
+	lower := strings.ToLower(archive)
+	switch {
+	case strings.HasSuffix(lower, ".zip"):
+		w = zipArchiveWriter{zip.NewWriter(f)}
+	case strings.HasSuffix(lower, ".tar"):
+		w = &tarArchiveWriter{tw: tar.NewWriter(f)}
+	case strings.HasSuffix(lower, ".tar.gz"), strings.HasSuffix(lower, ".tgz"):
+		gz := gzip.NewWriter(f)
+		w = &tarArchiveWriter{tw: tar.NewWriter(gz), gz: gz}
+	default:
+		f.Close()
+		os.Remove(f.Name())
+		return nil, fmt.Errorf("unsupported archive %s", archive)
+	}
+
+	s := &archiveSink{
+		path:    archive,
+		entries: make(chan archiveEntry),
+		done:    make(chan error, 1),
+	}
+	go s.write(f, w)
+	return s, nil
+}
+
+// write writes the entries sent to the sink until the sink is closed. After the first error
+// the remaining entries are discarded, and the error is reported by close.
+func (s *archiveSink) write(f *os.File, w archiveWriter) {
+	var err error
+	names := make(map[string]bool)
+	for entry := range s.entries {
+		if err != nil {
+			continue
+		}
+		err = w.add(uniqueEntryName(names, entry.name), entry.data)
+	}
+	if closeErr := w.Close(); err == nil {
+		err = closeErr
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), s.path)
+	} else {
+		os.Remove(f.Name())
+	}
+	s.done <- err
+}
+
+func (s *archiveSink) put(folder, name string, r io.Reader) error {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	s.entries <- archiveEntry{name: path.Join(filepath.ToSlash(folder), name), data: data}
+	_metrics.bytesCopied.add("", float64(len(data)))
+	return nil
+}
+
+func (s *archiveSink) close() error {
+	close(s.entries)
+	return <-s.done
+}
+
+// uniqueEntryName returns the given name, or the given name with a numeric suffix if it's
+// already in names, e.g. bill/party_2.jpg, and adds it to names. Pictures with the same name
+// from different folders of picsdir would otherwise end up as duplicated entries.
+func uniqueEntryName(names map[string]bool, name string) string {
+	ext := path.Ext(name)
+	unique := name
+	for i := 2; names[unique]; i++ {
+		unique = fmt.Sprintf("%s_%d%s", strings.TrimSuffix(name, ext), i, ext)
+	}
+	names[unique] = true
+	return unique
+}
+
+type zipArchiveWriter struct {
+	*zip.Writer
+}
+
+func (w zipArchiveWriter) add(name string, data []byte) error {
+	// The pictures are compressed already.
+	f, err := w.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Store, Modified: time.Now()})
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	return err
+}
+
+type tarArchiveWriter struct {
+	tw *tar.Writer
+	gz *gzip.Writer
+}
+
+func (w *tarArchiveWriter) add(name string, data []byte) error {
+	hdr := &tar.Header{Name: name, Mode: 0644, Size: int64(len(data)), ModTime: time.Now(), Typeflag: tar.TypeReg}
+	if err := w.tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err := w.tw.Write(data)
+	return err
+}
+
+func (w *tarArchiveWriter) Close() error {
+	err := w.tw.Close()
+	if w.gz != nil {
+		if gzErr := w.gz.Close(); err == nil {
+			err = gzErr
+		}
+	}
+	return err
+}
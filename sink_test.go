@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// readArchive returns the content of each file of the archive located in the given path.
+func readArchive(t *testing.T, path string) map[string][]byte {
+	files := make(map[string][]byte)
+	err := walkArchive(path, func(name string, size int64, open func() (io.ReadCloser, error)) error {
+		r, err := open()
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		b, err := ioutil.ReadAll(r)
+		files[name] = b
+		return err
+	})
+	if err != nil {
+		t.Fatalf("couldn't read the archive %s; got error %s", path, err)
+	}
+	return files
+}
+
+func Test_archiveSink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "coalescer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{"people.zip", "people.tar.gz"} {
+		path := filepath.Join(dir, name)
+		s, err := newArchiveSink(path)
+		if err != nil {
+			t.Fatalf("newArchiveSink shouldn't fail; got error %s", err)
+		}
+
+		// The digesters put the pictures concurrently.
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				folder := []string{"bill", "mark"}[i%2]
+				if err := s.put(folder, fmt.Sprintf("pic%d.jpg", i), strings.NewReader(folder)); err != nil {
+					t.Errorf("put shouldn't fail; got error %s", err)
+				}
+			}(i)
+		}
+		wg.Wait()
+		// Pictures with the same name shouldn't overwrite each other.
+		if err := s.put("bill", "pic0.jpg", strings.NewReader("another bill")); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.close(); err != nil {
+			t.Fatalf("close shouldn't fail; got error %s", err)
+		}
+
+		files := readArchive(t, path)
+		var names []string
+		for n := range files {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		if len(names) != 11 {
+			t.Fatalf("expected 11 files in %s; got %v", name, names)
+		}
+		for n, b := range files {
+			folder := strings.Split(n, "/")[0]
+			if n != "bill/pic0_2.jpg" && string(b) != folder {
+				t.Errorf("expected %s to contain %q; got %q", n, folder, b)
+			}
+		}
+		if !bytes.Equal(files["bill/pic0_2.jpg"], []byte("another bill")) {
+			t.Errorf("expected the second bill/pic0.jpg to be renamed to bill/pic0_2.jpg; got %v", names)
+		}
+		if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+			t.Errorf("the temporary archive should be removed")
+		}
+	}
+}
+
+func Test_run_with_output_archive(t *testing.T) {
+	dir, err := ioutil.TempDir("", "coalescer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	archive := filepath.Join(dir, "people.zip")
+
+	conf, output, err := parseFlags("coalescer", []string{"-faceboxurl=http://localhost:8080", "-peopledir=people_dir",
+		"-picsdir=pics_dir", "-confidence=50", "-output-archive=" + archive, "-manifest=" + filepath.Join(dir, "manifest.json")})
+	if err != nil {
+		t.Fatalf("got error (%s) while using parseFlags. Output was: %s", err, output)
+	}
+	if err := conf.Validate(); err != nil {
+		t.Fatalf("conf.Validate() should be valid got error: %s", err)
+	}
+
+	originalFacebox := fbox
+	fbox = &mockRecognizer{}
+	defer func(original recognizer) {
+		fbox = original
+	}(originalFacebox)
+
+	if err := run(conf); err != nil {
+		t.Fatalf("run shouldn't fail; got this err %s", err)
+	}
+
+	for _, d := range []string{"bill", "mark"} {
+		if _, err := os.Stat(d); !os.IsNotExist(err) {
+			os.RemoveAll(d)
+			t.Errorf("directory %s shouldn't be created when the pictures are stored in an archive", d)
+		}
+	}
+
+	files := readArchive(t, archive)
+	for _, name := range []string{"bill/bill_and_steve.jpg", "bill/mark_and_bill.jpg", "mark/mark_and_bill.jpg"} {
+		want, err := ioutil.ReadFile(filepath.Join("pics_dir", filepath.Base(name)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(files[name], want) {
+			t.Errorf("expected %s in the output archive", name)
+		}
+	}
+	if len(files) != 3 {
+		t.Errorf("expected 3 files in the output archive; got %d", len(files))
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+)
+
+// imageExtensions maps the file extensions of the pictures coalescer can read to their image formats.
+var imageExtensions = map[string]string{
+	".jpg":  "jpeg",
+	".jpeg": "jpeg",
+	".jpe":  "jpeg",
+	".png":  "png",
+	".gif":  "gif",
+	".bmp":  "bmp",
+	".tif":  "tiff",
+	".tiff": "tiff",
+	".webp": "webp",
+}
+
+// imageSignature represents the magic bytes at the beginning of the files of an image format.
+// The ? bytes of the magic match any byte.
+type imageSignature struct {
+	format string
+	magic  string
+}
+
+var imageSignatures = []imageSignature{
+	{"jpeg", "\xff\xd8\xff"},
+	{"png", "\x89PNG\r\n\x1a\n"},
+	{"gif", "GIF87a"},
+	{"gif", "GIF89a"},
+	{"bmp", "BM"},
+	{"tiff", "II*\x00"},
+	{"tiff", "MM\x00*"},
+	{"webp", "RIFF????WEBP"},
+}
+
+// sniffFormat returns the image format of the file whose first bytes are the given header,
+// or an empty string if the header doesn't belong to any of the formats coalescer can read.
+func sniffFormat(header []byte) string {
+	for _, sig := range imageSignatures {
+		if len(header) < len(sig.magic) {
+			continue
+		}
+		matches := true
+		for i := 0; i < len(sig.magic); i++ {
+			if sig.magic[i] != '?' && sig.magic[i] != header[i] {
+				matches = false
+				break
+			}
+		}
+		if matches {
+			return sig.format
+		}
+	}
+	return ""
+}
+
+// skipReason returns why the file located in the given path, whose content is read from r,
+// shouldn't be checked with facebox at all, or an empty string if it should. Files that
+// neither look like a picture by their extension nor by their content, like .DS_Store,
+// Thumbs.db, videos or sidecar files, are skipped, and so are the pictures in formats
+// the user didn't allow. Files that look like a picture by their extension but whose
+// content is broken aren't skipped, so they are reported as failures.
+func skipReason(conf *config, path string, r io.Reader) (string, error) {
+	header := make([]byte, 16)
+	n, err := io.ReadFull(r, header)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", err
+	}
+	format := sniffFormat(header[:n])
+	if format == "" {
+		format = imageExtensions[strings.ToLower(filepath.Ext(path))]
+	}
+	switch {
+	case format == "":
+		return "it is not a picture", nil
+	case !conf.formatAllowed(format):
+		return fmt.Sprintf("file of type %s is not one of the allowed formats (%s)", format, strings.Join(conf.AllowedFormats, ", ")), nil
+	}
+	return "", nil
+}
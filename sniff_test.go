@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func Test_sniffFormat(t *testing.T) {
+	tests := []struct {
+		header string
+		want   string
+	}{
+		{"\xff\xd8\xff\xe0\x00\x10JFIF", "jpeg"},
+		{"\x89PNG\r\n\x1a\n\x00\x00", "png"},
+		{"GIF89a\x10\x00", "gif"},
+		{"BM\x36\x00", "bmp"},
+		{"II*\x00\x08\x00", "tiff"},
+		{"MM\x00*\x00\x08", "tiff"},
+		{"RIFF\x24\x00\x00\x00WEBPVP8 ", "webp"},
+		{"RIFF\x24\x00\x00\x00AVI LIST", ""},
+		{"\x00\x00\x00\x18ftypmp42", ""},
+		{"Bud1", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := sniffFormat([]byte(tt.header)); got != tt.want {
+			t.Errorf("sniffFormat(%q) = %q; want %q", tt.header, got, tt.want)
+		}
+	}
+}
+
+func Test_recognizeAndCopy_skips_non_pictures(t *testing.T) {
+	dir, err := ioutil.TempDir("", "coalescer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string][]byte{
+		".DS_Store":     []byte("\x00\x00\x00\x01Bud1"),
+		"Thumbs.db":     []byte("\xd0\xcf\x11\xe0\xa1\xb1\x1a\xe1"),
+		"clip.mp4":      []byte("\x00\x00\x00\x18ftypmp42"),
+		"IMG_0001.xmp":  []byte("<x:xmpmeta xmlns:x=\"adobe:ns:meta/\">"),
+		"broken.jpg":    []byte("definitely not a jpeg"),
+		"no_extension":  append([]byte("GIF89a"), bytes.Repeat([]byte{0}, 10)...),
+		"empty_file.db": nil,
+	}
+	for name, b := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), b, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c, err := newConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.WorkingDir = dir
+
+	for _, name := range []string{".DS_Store", "Thumbs.db", "clip.mp4", "IMG_0001.xmp", "empty_file.db"} {
+		if re := recognizeAndCopy(c, name); re.skipped == "" || re.err != nil {
+			t.Errorf("recognizeAndCopy should skip %s; got skipped %q and error %v", name, re.skipped, re.err)
+		}
+	}
+
+	// A broken picture is a real failure.
+	if re := recognizeAndCopy(c, "broken.jpg"); re.skipped != "" || re.err == nil {
+		t.Errorf("recognizeAndCopy should fail with a broken picture; got skipped %q", re.skipped)
+	}
+
+	// Pictures are recognized by their content too, but gif is not one of the allowed formats.
+	if re := recognizeAndCopy(c, "no_extension"); re.skipped == "" {
+		t.Errorf("recognizeAndCopy should skip a GIF when only JPEG and PNG are allowed")
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+)
+
+// stateCommandName is the name of the subcommand that exports and imports the state of facebox.
+const stateCommandName = "state"
+
+// The names of the entries of an exported state file.
+const (
+	stateManifestEntry = "manifest.json"
+	stateFaceboxEntry  = "facebox.state"
+)
+
+// stateCommand runs the state subcommand with the given arguments, e.g.:
+//
+//	coalescer state export -faceboxurl=http://localhost:8080 people.state
+//	coalescer state import -faceboxurl=http://localhost:8080 people.state
+//
+// An exported state file is a zip archive with the state of facebox and the manifest of
+// the people and pictures that were taught, so a trained set can be shared without sharing
+// the original reference pictures.
+func stateCommand(programName string, args []string) int {
+	usage := fmt.Errorf("usage: %s export|import [flags] <file>", programName)
+	if len(args) == 0 {
+		return failWith(exitConfig, usage)
+	}
+	action := args[0]
+	if action != "export" && action != "import" {
+		return failWith(exitConfig, usage)
+	}
+
+	flags := flag.NewFlagSet(programName+" "+action, flag.ContinueOnError)
+	var buf bytes.Buffer
+	flags.SetOutput(&buf)
+	c, err := newConfig()
+	if err != nil {
+		return failWith(exitError, err)
+	}
+	flags.StringVar(&c.FaceboxUrl, faceboxUrlFlag, "", "Represents the url of the facebox machine instance.")
+	flags.StringVar(&c.ManifestPath, manifestFlag, "./coalescer.manifest.json", "Represents the file where coalescer keeps track of the pictures it has taught to facebox.")
+	if err := flags.Parse(args[1:]); err != nil {
+		return failWith(exitConfig, fmt.Errorf("%s\n%s", err, buf.String()))
+	}
+	if flags.NArg() != 1 {
+		return failWith(exitConfig, usage)
+	}
+	if ok, msg := validateFaceboxUrl(c.FaceboxUrl); !ok {
+		return failWith(exitConfig, errors.New(msg))
+	}
+
+	if err := connectFacebox(c.FaceboxUrl); err != nil {
+		return failWith(exitUnreachable, err)
+	}
+
+	if action == "export" {
+		err = exportState(c, flags.Arg(0))
+	} else {
+		err = importState(c, flags.Arg(0))
+	}
+	if err != nil {
+		return failWith(exitCode(err), err)
+	}
+	return exitOK
+}
+
+// exportState writes the state of facebox and the manifest in config.ManifestPath to the
+// given file.
+func exportState(c *config, path string) (err error) {
+	m, err := loadManifest(c.ManifestPath)
+	if err != nil {
+		return err
+	}
+	m.FaceboxUrl = ""
+
+	state, err := fbox.OpenState()
+	if err != nil {
+		return err
+	}
+	defer state.Close()
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if closeErr := f.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}()
+
+	zw := zip.NewWriter(f)
+	w, err := zw.Create(stateManifestEntry)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(m); err != nil {
+		return err
+	}
+	w, err = zw.Create(stateFaceboxEntry)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, state); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+
+	fmt.Printf("Exported the state of %d pictures to %s.\n", len(m.Faces), path)
+	return nil
+}
+
+// importState uploads the state of facebox stored in the given file and replaces the
+// manifest in config.ManifestPath with the one stored in the file.
+func importState(c *config, path string) error {
+	zr, err := zip.OpenReader(path)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+
+	var manifestFile, stateFile *zip.File
+	for _, f := range zr.File {
+		switch f.Name {
+		case stateManifestEntry:
+			manifestFile = f
+		case stateFaceboxEntry:
+			stateFile = f
+		}
+	}
+	if manifestFile == nil || stateFile == nil {
+		return fmt.Errorf("%s is not a valid state file", path)
+	}
+
+	m := newManifest(c.FaceboxUrl)
+	r, err := manifestFile.Open()
+	if err != nil {
+		return err
+	}
+	err = json.NewDecoder(r).Decode(m)
+	r.Close()
+	if err != nil {
+		return fmt.Errorf("couldn't read the manifest in %s; got error %s", path, err)
+	}
+	m.FaceboxUrl = c.FaceboxUrl
+	if m.Faces == nil {
+		m.Faces = make(map[string]manifestEntry)
+	}
+	// The pictures of the state aren't in our peopledir, so the next run must keep them.
+	for id, entry := range m.Faces {
+		entry.Imported = true
+		m.Faces[id] = entry
+	}
+
+	r, err = stateFile.Open()
+	if err != nil {
+		return err
+	}
+	err = fbox.PostState(r)
+	r.Close()
+	if err != nil {
+		return err
+	}
+
+	if err := m.save(c.ManifestPath); err != nil {
+		return err
+	}
+
+	fmt.Printf("Imported the state of %d pictures from %s.\n", len(m.Faces), path)
+	return nil
+}
+
+// importedPeople returns the names of the people taught through an imported state to the
+// facebox instance defined in config.FaceboxUrl, according to the manifest.
+func importedPeople(c *config) (map[string]bool, error) {
+	m, err := loadManifest(c.ManifestPath)
+	if err != nil {
+		return nil, err
+	}
+	names := make(map[string]bool)
+	if m.FaceboxUrl != c.FaceboxUrl {
+		return names, nil
+	}
+	for _, entry := range m.Faces {
+		if entry.Imported {
+			names[entry.Name] = true
+		}
+	}
+	return names, nil
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// stateRecorder is a recognizer that keeps the state posted to it.
+type stateRecorder struct {
+	mockRecognizer
+	state []byte
+}
+
+func (r *stateRecorder) OpenState() (io.ReadCloser, error) {
+	return ioutil.NopCloser(bytes.NewReader(r.state)), nil
+}
+
+func (r *stateRecorder) PostState(rd io.Reader) error {
+	b, err := ioutil.ReadAll(rd)
+	r.state = b
+	return err
+}
+
+func Test_exportState_and_importState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "coalescer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c, err := newConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.FaceboxUrl = "http://localhost:8080"
+	c.ManifestPath = filepath.Join(dir, "manifest.json")
+
+	m := newManifest(c.FaceboxUrl)
+	m.Faces["bill_gates_1.jpg"] = manifestEntry{Name: "bill", Hash: "7069fe1154a9f399bc506850d7bc46553ef39cac"}
+	if err := m.save(c.ManifestPath); err != nil {
+		t.Fatal(err)
+	}
+
+	originalFacebox := fbox
+	fbox = &stateRecorder{state: []byte("trained state")}
+	defer func(original recognizer) {
+		fbox = original
+	}(originalFacebox)
+
+	stateFile := filepath.Join(dir, "people.state")
+	if err := exportState(c, stateFile); err != nil {
+		t.Fatalf("exportState shouldn't fail; got error %s", err)
+	}
+
+	// Let's import the state in another facebox instance with a different manifest.
+	other := &stateRecorder{}
+	fbox = other
+	c.FaceboxUrl = "http://localhost:9090"
+	c.ManifestPath = filepath.Join(dir, "other_manifest.json")
+	if err := importState(c, stateFile); err != nil {
+		t.Fatalf("importState shouldn't fail; got error %s", err)
+	}
+
+	if string(other.state) != "trained state" {
+		t.Errorf("expected the state %q to be posted to facebox; got %q", "trained state", other.state)
+	}
+
+	imported, err := loadManifest(c.ManifestPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if imported.FaceboxUrl != c.FaceboxUrl {
+		t.Errorf("expected the imported manifest to belong to %s; got %s", c.FaceboxUrl, imported.FaceboxUrl)
+	}
+	want := m.Faces["bill_gates_1.jpg"]
+	want.Imported = true
+	if imported.Faces["bill_gates_1.jpg"] != want {
+		t.Errorf("expected the imported manifest to contain bill_gates_1.jpg as imported; got %v", imported.Faces)
+	}
+}
+
+func Test_importState_invalid_file(t *testing.T) {
+	dir, err := ioutil.TempDir("", "coalescer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c, err := newConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.ManifestPath = filepath.Join(dir, "manifest.json")
+
+	if err := importState(c, "people_dir/bill_gates_1.jpg"); err == nil {
+		t.Errorf("importState should fail with a file that is not a state file")
+	}
+}
+
+func Test_run_after_importState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "coalescer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	markAndBill, err := ioutil.ReadFile("pics_dir/mark_and_bill.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range []string{"people", "pics"} {
+		if err := os.Mkdir(filepath.Join(dir, d), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "pics", "mark_and_bill.jpg"), markAndBill, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Let's export the state of a facebox instance taught somewhere else.
+	c, err := newConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.ManifestPath = filepath.Join(dir, "other_manifest.json")
+	m := newManifest("http://localhost:9090")
+	m.Faces["bill_gates_1.jpg"] = manifestEntry{Name: "bill", Hash: "7069fe1154a9f399bc506850d7bc46553ef39cac"}
+	m.Faces["mark_zuckerberg_1.jpg"] = manifestEntry{Name: "mark", Hash: "5e1b1ee4c8c1a4ff5d2ad0d6fcd4a0a4b8bd35d7"}
+	if err := m.save(c.ManifestPath); err != nil {
+		t.Fatal(err)
+	}
+	originalFacebox := fbox
+	fbox = &stateRecorder{state: []byte("trained state")}
+	defer func(original recognizer) {
+		fbox = original
+	}(originalFacebox)
+	stateFile := filepath.Join(dir, "people.state")
+	if err := exportState(c, stateFile); err != nil {
+		t.Fatal(err)
+	}
+
+	// Then import it and sort the pictures without any reference picture in peopledir.
+	c, output, err := parseFlags("coalescer", []string{
+		"-faceboxurl=http://localhost:8080",
+		"-peopledir=" + filepath.Join(dir, "people"),
+		"-picsdir=" + filepath.Join(dir, "pics"),
+		"-manifest=" + filepath.Join(dir, "manifest.json"),
+		"-confidence=50",
+	})
+	if err != nil {
+		t.Fatalf("got error (%s) while using parseFlags. Output was: %s", err, output)
+	}
+	c.WorkingDir = dir
+	recorder := &teachRecorder{known: make(map[string]string)}
+	fbox = recorder
+	if err := importState(c, stateFile); err != nil {
+		t.Fatalf("importState shouldn't fail; got error %s", err)
+	}
+	if err := c.Validate(); err != nil {
+		t.Fatalf("an empty peopledir should be valid after importing a state; got error %s", err)
+	}
+	if err := run(c); err != nil {
+		t.Fatalf("run shouldn't fail; got error %s", err)
+	}
+
+	if len(recorder.removed) != 0 || len(recorder.taught) != 0 {
+		t.Errorf("expected the imported pictures to be kept; got %v removed and %v taught", recorder.removed, recorder.taught)
+	}
+	after, err := loadManifest(c.ManifestPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(after.Faces) != 2 {
+		t.Errorf("expected the manifest to keep the imported pictures; got %v", after.Faces)
+	}
+	for _, d := range []string{"bill", "mark"} {
+		if _, err := os.Stat(filepath.Join(dir, d, "mark_and_bill.jpg")); err != nil {
+			t.Errorf("expected the picture to be copied to %s; got error %s", d, err)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"text/tabwriter"
+)
+
+// runSummary represents the outcome of checking the files of a run.
+type runSummary struct {
+	succeeded  int
+	noMatch    int
+	failed     int
+	skipped    int
+	duplicates int
+
+	// matches maps each destination folder to the number of pictures copied to it.
+	matches map[string]int
+}
+
+// newRunSummary creates a runSummary with no matches yet for each of the destination
+// folders of the given config, so the people nobody found are listed too.
+func newRunSummary(c *config) *runSummary {
+	s := &runSummary{matches: make(map[string]int)}
+	if c.MatchMultiple {
+		s.matches[c.PeopleCombinedDirName] = 0
+		return s
+	}
+	for name := range c.People {
+		s.matches[name] = 0
+	}
+	return s
+}
+
+// add counts the given result of a file. Pictures that don't match anyone aren't failures:
+// they are what most pictures of a library look like.
+func (s *runSummary) add(re result) {
+	switch {
+	case re.skipped != "":
+		s.skipped++
+	case re.duplicateOf != "":
+		s.duplicates++
+	case re.err == nil:
+		s.succeeded++
+		for _, dest := range re.destinations {
+			s.matches[dest]++
+		}
+	case errorKind(re.err) == errorKindNoMatch:
+		s.noMatch++
+	default:
+		s.failed++
+	}
+}
+
+// checked returns the number of files the summary counts.
+func (s *runSummary) checked() int {
+	return s.succeeded + s.noMatch + s.failed + s.skipped + s.duplicates
+}
+
+// printRunSummary writes the given summary to w, with a table of the pictures matched per person.
+func printRunSummary(w io.Writer, s *runSummary) {
+	fmt.Fprintf(w, "Checked %d files: %d succeeded, %d didn't match, %d failed, %d skipped, %d duplicates.\n",
+		s.checked(), s.succeeded, s.noMatch, s.failed, s.skipped, s.duplicates)
+
+	names := make([]string, 0, len(s.matches))
+	for name := range s.matches {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "  PERSON\tPICTURES")
+	for _, name := range names {
+		fmt.Fprintf(tw, "  %s\t%d\n", name, s.matches[name])
+	}
+	tw.Flush()
+}
+
+// tooManyFailuresError is returned by run when more files failed than config.MaxFailures allows.
+type tooManyFailuresError struct {
+	failed int
+	max    int
+}
+
+func (e *tooManyFailuresError) Error() string {
+	return fmt.Sprintf("%d files failed, more than the %d allowed by the %s flag; see the log for the errors",
+		e.failed, e.max, maxFailuresFlag)
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func Test_printRunSummary(t *testing.T) {
+	c, err := newConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.People = PeopleToIdentify{"bill": nil, "mark": nil, "steve": nil}
+
+	s := newRunSummary(c)
+	s.add(result{path: "mark_and_bill.jpg", destinations: []string{"bill", "mark"}})
+	s.add(result{path: "bill_and_steve.jpg", destinations: []string{"bill"}})
+	s.add(result{path: "beach.jpg", err: fmt.Errorf("%w with a confidence 0.50", errNoMatch)})
+	s.add(result{path: "broken.jpg", err: recognizerError{errors.New("connection refused")}})
+	s.add(result{path: ".DS_Store", skipped: "it isn't a picture"})
+	s.add(result{path: "copy.jpg", duplicateOf: "mark_and_bill.jpg"})
+
+	var buf bytes.Buffer
+	printRunSummary(&buf, s)
+	want := `Checked 6 files: 2 succeeded, 1 didn't match, 1 failed, 1 skipped, 1 duplicates.
+  PERSON  PICTURES
+  bill    2
+  mark    1
+  steve   0
+`
+	if buf.String() != want {
+		t.Errorf("expected the summary\n%s\ngot\n%s", want, buf.String())
+	}
+}
+
+func Test_exitCode(t *testing.T) {
+	scenarios := []struct {
+		err  error
+		code int
+	}{
+		{nil, exitOK},
+		{errors.New("we couldn't save the result index"), exitError},
+		{configError{errors.New("incorrect file name bill.jpg")}, exitConfig},
+		{&tooManyFailuresError{failed: 3, max: 1}, exitTooManyFailures},
+	}
+	for _, s := range scenarios {
+		if got := exitCode(s.err); got != s.code {
+			t.Errorf("expected the exit code %d for %v; got %d", s.code, s.err, got)
+		}
+	}
+}
+
+func Test_run_with_max_failures(t *testing.T) {
+	dir, err := ioutil.TempDir("", "coalescer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	markAndBill, err := ioutil.ReadFile("pics_dir/mark_and_bill.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	picsDir := filepath.Join(dir, "pics")
+	if err := os.Mkdir(picsDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(picsDir, "mark_and_bill.jpg"), markAndBill, 0644); err != nil {
+		t.Fatal(err)
+	}
+	// A truncated picture that cannot be decoded.
+	if err := ioutil.WriteFile(filepath.Join(picsDir, "broken.jpg"), markAndBill[:64], 0644); err != nil {
+		t.Fatal(err)
+	}
+	peopleDir, err := filepath.Abs(testPeopleDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	originalFacebox := fbox
+	fbox = &mockRecognizer{}
+	defer func(original recognizer) {
+		fbox = original
+	}(originalFacebox)
+
+	for maxFailures, wantErr := range map[int]bool{0: true, 1: false} {
+		conf, output, err := parseFlags("coalescer", []string{"-faceboxurl=http://localhost:8080", "-peopledir=" + peopleDir,
+			"-picsdir=" + picsDir, "-confidence=50", "-cooldown=false", "-manifest=" + filepath.Join(dir, "manifest.json"),
+			fmt.Sprintf("-max-failures=%d", maxFailures)})
+		if err != nil {
+			t.Fatalf("got error (%s) while using parseFlags. Output was: %s", err, output)
+		}
+		if err := conf.Validate(); err != nil {
+			t.Fatalf("conf.Validate() should be valid got error: %s", err)
+		}
+		conf.WorkingDir = dir
+
+		err = run(conf)
+		var failuresErr *tooManyFailuresError
+		if wantErr && !errors.As(err, &failuresErr) {
+			t.Errorf("run should fail with too many failures when max-failures is %d; got error %v", maxFailures, err)
+		}
+		if !wantErr && err != nil {
+			t.Errorf("run shouldn't fail when max-failures is %d; got error %s", maxFailures, err)
+		}
+	}
+}
@@ -0,0 +1,368 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/machinebox/sdk-go/facebox"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// teachingReport summarizes the quality of the reference pictures of a single person
+// found in peopledir.
+type teachingReport struct {
+	// Accepted holds the filenames of the pictures that can be taught to facebox.
+	Accepted []string
+
+	// Rejected maps the filenames of the pictures that won't be taught to the reason why.
+	Rejected map[string]string
+
+	// Conflicts maps the filenames of the pictures that facebox already recognizes
+	// as a different person to the name of that person.
+	Conflicts map[string]string
+
+	// Recognized holds the filenames of the pictures that facebox already recognizes
+	// as this person.
+	Recognized map[string]bool
+}
+
+func newTeachingReport() *teachingReport {
+	return &teachingReport{
+		Rejected:   make(map[string]string),
+		Conflicts:  make(map[string]string),
+		Recognized: make(map[string]bool),
+	}
+}
+
+// validateTeachingPics checks every reference picture in config.People with facebox before
+// we teach anything. Only pictures with exactly one face are accepted; the rest are removed
+// from config.People so they can neither abort the teaching nor poison the model. People
+// without any accepted picture are removed from config.People too. If facebox itself fails,
+// validateTeachingPics aborts with a recognizerError, since no picture can be validated.
+func validateTeachingPics(c *config) (map[string]*teachingReport, error) {
+	reports := make(map[string]*teachingReport)
+	for name, paths := range c.People {
+		// The people taught through an imported state have no pictures to check.
+		if len(paths) == 0 {
+			continue
+		}
+		report := newTeachingReport()
+		for _, p := range paths {
+			faces, err := checkTeachingPic(filepath.Join(c.resolve(c.PeopleDir), p))
+			var recErr recognizerError
+			if errors.As(err, &recErr) {
+				return reports, fmt.Errorf("facebox couldn't check the picture %s; got error %w", p, err)
+			} else if err != nil {
+				report.Rejected[p] = fmt.Sprintf("the picture cannot be read; got error %s", err)
+				continue
+			}
+			if len(faces) != 1 {
+				report.Rejected[p] = fmt.Sprintf("expected exactly one face; got %d", len(faces))
+				continue
+			}
+			if faces[0].Matched && faces[0].Name != name {
+				report.Conflicts[p] = faces[0].Name
+			}
+			if faces[0].Matched && faces[0].Name == name {
+				report.Recognized[p] = true
+			}
+			report.Accepted = append(report.Accepted, p)
+		}
+		reports[name] = report
+
+		if len(report.Accepted) == 0 {
+			delete(c.People, name)
+		} else {
+			c.People[name] = report.Accepted
+		}
+	}
+
+	if len(c.People) == 0 {
+		return reports, configError{fmt.Errorf("there are no valid pictures to teach facebox in %s", c.PeopleDir)}
+	}
+	return reports, nil
+}
+
+// checkTeachingPic returns the faces facebox finds in the picture located in the given path.
+func checkTeachingPic(path string) ([]facebox.Face, error) {
+	img, err := openForRecognizer(path)
+	if err != nil {
+		return nil, err
+	}
+	defer img.Close()
+	faces, err := fbox.Check(img)
+	if err != nil {
+		return nil, recognizerError{err}
+	}
+	return faces, nil
+}
+
+// printTeachingSummary writes a per-person summary of the given reports to w.
+func printTeachingSummary(w io.Writer, reports map[string]*teachingReport) {
+	names := make([]string, 0, len(reports))
+	for name := range reports {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Fprintln(w, "Reference pictures summary:")
+	for _, name := range names {
+		r := reports[name]
+		fmt.Fprintf(w, "  %s: %d accepted, %d rejected, %d conflicts\n",
+			name, len(r.Accepted), len(r.Rejected), len(r.Conflicts))
+		for _, p := range sortedKeys(r.Rejected) {
+			fmt.Fprintf(w, "    rejected %s: %s\n", p, r.Rejected[p])
+		}
+		for _, p := range sortedKeys(r.Conflicts) {
+			fmt.Fprintf(w, "    warning %s: facebox already recognizes this picture as %s\n", p, r.Conflicts[p])
+		}
+	}
+}
+
+// sortedKeys returns the keys of the given map in increasing order.
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// manifest represents what coalescer has taught to a facebox instance.
+type manifest struct {
+	FaceboxUrl string `json:"facebox_url"`
+
+	// Faces maps the facebox IDs of the taught pictures to their manifest entries.
+	Faces map[string]manifestEntry `json:"faces"`
+}
+
+// manifestEntry represents a single picture taught to facebox.
+type manifestEntry struct {
+	Name string `json:"name"`
+	Hash string `json:"hash"`
+
+	// Imported is true for the pictures taught through an imported state, which have no
+	// file in peopledir. See importState.
+	Imported bool `json:"imported,omitempty"`
+}
+
+func newManifest(faceboxUrl string) *manifest {
+	return &manifest{
+		FaceboxUrl: faceboxUrl,
+		Faces:      make(map[string]manifestEntry),
+	}
+}
+
+// loadManifest reads the manifest stored in the given path. If the file doesn't exist
+// yet loadManifest returns an empty manifest.
+func loadManifest(path string) (*manifest, error) {
+	m := newManifest("")
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return m, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, m); err != nil {
+		return nil, fmt.Errorf("couldn't read the manifest %s; got error %s", path, err)
+	}
+	if m.Faces == nil {
+		m.Faces = make(map[string]manifestEntry)
+	}
+	return m, nil
+}
+
+// save writes the manifest to the given path.
+func (m *manifest) save(path string) error {
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// desiredManifest computes the manifest that facebox should have according to the
+// pictures in config.People. The filenames of the pictures are used as facebox IDs.
+func desiredManifest(c *config) (*manifest, error) {
+	m := newManifest(c.FaceboxUrl)
+	for name, paths := range c.People {
+		for _, p := range paths {
+			hash, err := hashFile(filepath.Join(c.resolve(c.PeopleDir), p))
+			if err != nil {
+				return nil, err
+			}
+			m.Faces[filepath.Base(p)] = manifestEntry{Name: name, Hash: hash}
+		}
+	}
+	return m, nil
+}
+
+// hashFile returns the hex encoded sha1 checksum of the file located in the given path.
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha1.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// teachingPlan holds the facebox IDs that need to be removed from and taught to facebox.
+type teachingPlan struct {
+	remove []string
+	teach  []string
+}
+
+// planTeaching compares what was taught to facebox according to the current manifest with
+// the desired manifest. Pictures that are in the current manifest but that facebox doesn't
+// recognize anymore, e.g. because the facebox instance was restarted, are taught again.
+// If reteach is true every picture is removed and taught again. The imported pictures are
+// kept unless a picture in peopledir replaces them, since they cannot be taught again.
+func planTeaching(current, desired *manifest, reports map[string]*teachingReport, reteach bool) teachingPlan {
+	var plan teachingPlan
+	for id, entry := range current.Faces {
+		want, ok := desired.Faces[id]
+		if entry.Imported && !ok {
+			continue
+		}
+		if reteach || !ok || want != entry {
+			plan.remove = append(plan.remove, id)
+		}
+	}
+	for id, want := range desired.Faces {
+		entry, ok := current.Faces[id]
+		upToDate := ok && entry == want && reports[want.Name] != nil && reports[want.Name].Recognized[id]
+		if reteach || !upToDate {
+			plan.teach = append(plan.teach, id)
+		}
+	}
+	sort.Strings(plan.remove)
+	sort.Strings(plan.teach)
+	return plan
+}
+
+// teachFacebox will synchronize the facebox instance with the people we want to recognize.
+// It only removes the pictures that are no longer in peopledir, or that have changed, and
+// only teaches the pictures facebox doesn't know yet. What was taught is tracked in the
+// manifest defined in config.ManifestPath. If the coolDownPeriodFlag is true and something
+// was taught, we will wait until facebox has assimilated the pictures. See waitForFacebox.
+func teachFacebox(c *config, reports map[string]*teachingReport) (err error) {
+	current, err := loadManifest(c.ManifestPath)
+	if err != nil {
+		return err
+	}
+	// A manifest of another facebox instance tells us nothing about this one.
+	if current.FaceboxUrl != c.FaceboxUrl {
+		current = newManifest(c.FaceboxUrl)
+	}
+
+	desired, err := desiredManifest(c)
+	if err != nil {
+		return err
+	}
+
+	plan := planTeaching(current, desired, reports, c.Reteach)
+
+	defer func() {
+		if saveErr := current.save(c.ManifestPath); saveErr != nil && err == nil {
+			err = saveErr
+		}
+	}()
+
+	for _, id := range plan.remove {
+		// The facebox instance might have lost its state already, so we don't want to
+		// abort the whole run because of a picture that cannot be removed.
+		if err := fbox.Remove(id); err != nil {
+			_logger.Warn("Failed to remove a picture from facebox", field("id", id), field("error", err))
+		}
+		delete(current.Faces, id)
+	}
+
+	for _, id := range plan.teach {
+		entry := desired.Faces[id]
+		img, err := openForRecognizer(filepath.Join(c.resolve(c.PeopleDir), id))
+		if err != nil {
+			return err
+		}
+		err = fbox.Teach(img, id, entry.Name)
+		img.Close()
+		if err != nil {
+			return fmt.Errorf("facebox couldn't learn the picture %s; got error %w", id, recognizerError{err})
+		}
+		current.Faces[id] = entry
+	}
+
+	fmt.Printf("Synchronized facebox: %d pictures removed, %d pictures taught.\n", len(plan.remove), len(plan.teach))
+
+	if c.CoolDownPeriod && len(plan.teach) > 0 {
+		waitForFacebox(c, desired, plan.teach)
+	}
+
+	return nil
+}
+
+// readinessPollInterval represents how often waitForFacebox checks whether facebox has
+// assimilated the taught pictures.
+var readinessPollInterval = 500 * time.Millisecond
+
+// coolDownFallback represents how long waitForFacebox waits when it cannot verify
+// whether facebox has assimilated the taught pictures.
+var coolDownFallback = 5 * time.Second
+
+// waitForFacebox waits until facebox recognizes one of the taught pictures of each person
+// or until config.CoolDownTimeout expires. If facebox cannot check the pictures we will
+// wait for the fixed coolDownFallback period instead.
+func waitForFacebox(c *config, desired *manifest, taught []string) {
+	// We only need one picture of each person to know whether facebox is ready.
+	probes := make(map[string]string)
+	for _, id := range taught {
+		name := desired.Faces[id].Name
+		if _, ok := probes[name]; !ok {
+			probes[name] = id
+		}
+	}
+
+	fmt.Printf("Waiting up to %s for facebox to assimilate the people's pictures, please wait...\n", c.CoolDownTimeout)
+	deadline := time.Now().Add(c.CoolDownTimeout)
+	for {
+		for name, id := range probes {
+			faces, err := checkTeachingPic(filepath.Join(c.resolve(c.PeopleDir), id))
+			if err != nil {
+				_logger.Warn("Couldn't verify whether facebox is ready", field("error", err))
+				fmt.Printf("There would be a cooldown period of %s, please wait...\n", coolDownFallback)
+				time.Sleep(coolDownFallback)
+				return
+			}
+			for _, face := range faces {
+				if face.Matched && face.Name == name {
+					delete(probes, name)
+					break
+				}
+			}
+		}
+		if len(probes) == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			fmt.Printf("facebox didn't recognize %d people after %s; the results might be incomplete.\n", len(probes), c.CoolDownTimeout)
+			_logger.Warn("facebox didn't recognize some people in time", field("people", fmt.Sprint(probes)), field("timeout", c.CoolDownTimeout))
+			return
+		}
+		time.Sleep(readinessPollInterval)
+	}
+}
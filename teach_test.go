@@ -0,0 +1,324 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/machinebox/sdk-go/facebox"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// checkFuncRecognizer is a recognizer whose Check method can be customized in each test.
+type checkFuncRecognizer struct {
+	mockRecognizer
+	check func(image io.Reader) ([]facebox.Face, error)
+}
+
+func (c *checkFuncRecognizer) Check(image io.Reader) ([]facebox.Face, error) {
+	return c.check(image)
+}
+
+func Test_validateTeachingPics(t *testing.T) {
+	c, err := newConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.PeopleDir = testPeopleDir
+	if err := collectPeoplePics(c); err != nil {
+		t.Fatal(err)
+	}
+
+	groupPic, err := ioutil.ReadFile("people_dir/bill_gates_2.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conflictPic, err := ioutil.ReadFile("people_dir/mark_zuckerberg_1.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	originalFacebox := fbox
+	fbox = &checkFuncRecognizer{check: func(image io.Reader) ([]facebox.Face, error) {
+		b, err := ioutil.ReadAll(image)
+		if err != nil {
+			return nil, err
+		}
+		// Let's pretend that bill_gates_2.jpg has two faces and that facebox already
+		// knows mark_zuckerberg_1.jpg as bill.
+		switch {
+		case bytes.Equal(b, groupPic):
+			return []facebox.Face{{}, {}}, nil
+		case bytes.Equal(b, conflictPic):
+			return []facebox.Face{{Name: "bill", Matched: true, Confidence: 0.8}}, nil
+		}
+		return []facebox.Face{{}}, nil
+	}}
+	defer func(original recognizer) {
+		fbox = original
+	}(originalFacebox)
+
+	reports, err := validateTeachingPics(c)
+	if err != nil {
+		t.Fatalf("validateTeachingPics shouldn't fail; got error %s", err)
+	}
+
+	if _, rejected := reports["bill"].Rejected["bill_gates_2.jpg"]; !rejected {
+		t.Errorf("bill_gates_2.jpg should have been rejected")
+	}
+	for _, p := range c.People["bill"] {
+		if p == "bill_gates_2.jpg" {
+			t.Errorf("bill_gates_2.jpg shouldn't be taught to facebox")
+		}
+	}
+	if len(c.People["bill"]) != 2 {
+		t.Errorf("expected 2 pictures of bill to be taught; got %d", len(c.People["bill"]))
+	}
+
+	if name := reports["mark"].Conflicts["mark_zuckerberg_1.jpg"]; name != "bill" {
+		t.Errorf("expected mark_zuckerberg_1.jpg to conflict with bill; got %q", name)
+	}
+	if len(c.People["mark"]) != 2 {
+		t.Errorf("expected 2 pictures of mark to be taught; got %d", len(c.People["mark"]))
+	}
+
+	var buf bytes.Buffer
+	printTeachingSummary(&buf, reports)
+	for _, s := range []string{"bill: 2 accepted, 1 rejected, 0 conflicts", "mark: 2 accepted, 0 rejected, 1 conflicts"} {
+		if !strings.Contains(buf.String(), s) {
+			t.Errorf("expected summary to contain %q; got %s", s, buf.String())
+		}
+	}
+}
+
+func Test_validateTeachingPics_without_valid_pictures(t *testing.T) {
+	c, err := newConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.PeopleDir = testPeopleDir
+	if err := collectPeoplePics(c); err != nil {
+		t.Fatal(err)
+	}
+
+	originalFacebox := fbox
+	fbox = &checkFuncRecognizer{check: func(image io.Reader) ([]facebox.Face, error) {
+		return nil, nil
+	}}
+	defer func(original recognizer) {
+		fbox = original
+	}(originalFacebox)
+
+	_, err = validateTeachingPics(c)
+	if err == nil {
+		t.Errorf("validateTeachingPics should fail when there are no faces in the people's pictures")
+	} else if code := exitCode(err); code != exitConfig {
+		t.Errorf("expected the exit code %d; got %d", exitConfig, code)
+	}
+	if len(c.People) != 0 {
+		t.Errorf("expected no people to teach; got %d", len(c.People))
+	}
+}
+
+func Test_validateTeachingPics_when_facebox_fails(t *testing.T) {
+	c, err := newConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.PeopleDir = testPeopleDir
+	if err := collectPeoplePics(c); err != nil {
+		t.Fatal(err)
+	}
+
+	originalFacebox := fbox
+	fbox = &checkFuncRecognizer{check: func(image io.Reader) ([]facebox.Face, error) {
+		return nil, fmt.Errorf("connection refused")
+	}}
+	defer func(original recognizer) {
+		fbox = original
+	}(originalFacebox)
+
+	_, err = validateTeachingPics(c)
+	var recErr recognizerError
+	if !errors.As(err, &recErr) {
+		t.Fatalf("validateTeachingPics should fail with a recognizerError when facebox fails; got %v", err)
+	}
+	if code := exitCode(err); code != exitUnreachable {
+		t.Errorf("expected the exit code %d when facebox fails; got %d", exitUnreachable, code)
+	}
+}
+
+// teachRecorder is a recognizer that records the pictures taught to it and recognizes
+// the reference pictures that have been taught.
+type teachRecorder struct {
+	mockRecognizer
+	known   map[string]string
+	taught  []string
+	removed []string
+}
+
+func (r *teachRecorder) Teach(image io.Reader, id string, name string) error {
+	r.taught = append(r.taught, id)
+	r.known[id] = name
+	return nil
+}
+
+func (r *teachRecorder) Remove(id string) error {
+	r.removed = append(r.removed, id)
+	delete(r.known, id)
+	return nil
+}
+
+func Test_teachFacebox_synchronization(t *testing.T) {
+	dir, err := ioutil.TempDir("", "coalescer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c, err := newConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.PeopleDir = testPeopleDir
+	c.FaceboxUrl = "http://localhost:8080"
+	c.ManifestPath = filepath.Join(dir, "manifest.json")
+
+	recorder := &teachRecorder{known: make(map[string]string)}
+	originalFacebox := fbox
+	fbox = recorder
+	defer func(original recognizer) {
+		fbox = original
+	}(originalFacebox)
+
+	// sync collects and validates the people's pictures as run does, pretending that
+	// facebox recognizes every picture it was taught, and then teaches facebox.
+	sync := func() {
+		recorder.taught, recorder.removed = nil, nil
+		c.People = make(PeopleToIdentify)
+		if err := collectPeoplePics(c); err != nil {
+			t.Fatal(err)
+		}
+		reports := make(map[string]*teachingReport)
+		for name, paths := range c.People {
+			reports[name] = newTeachingReport()
+			reports[name].Accepted = paths
+			for _, p := range paths {
+				if recorder.known[p] == name {
+					reports[name].Recognized[p] = true
+				}
+			}
+		}
+		if err := teachFacebox(c, reports); err != nil {
+			t.Fatalf("teachFacebox shouldn't fail; got error %s", err)
+		}
+	}
+
+	// The first time every picture should be taught.
+	sync()
+	if len(recorder.taught) != 5 || len(recorder.removed) != 0 {
+		t.Fatalf("expected 5 pictures taught and 0 removed; got %v and %v", recorder.taught, recorder.removed)
+	}
+
+	// Nothing changed, so nothing should be taught nor removed.
+	sync()
+	if len(recorder.taught) != 0 || len(recorder.removed) != 0 {
+		t.Errorf("expected nothing to be taught nor removed; got %v and %v", recorder.taught, recorder.removed)
+	}
+
+	// If facebox forgets a picture it should be taught again.
+	delete(recorder.known, "mark_zuckerberg_2.jpg")
+	sync()
+	if len(recorder.taught) != 1 || recorder.taught[0] != "mark_zuckerberg_2.jpg" || len(recorder.removed) != 0 {
+		t.Errorf("expected only mark_zuckerberg_2.jpg to be taught again; got %v and %v", recorder.taught, recorder.removed)
+	}
+
+	// A picture that is no longer in peopledir should be removed from facebox.
+	m, err := loadManifest(c.ManifestPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Faces["bill_gates_9.jpg"] = manifestEntry{Name: "bill", Hash: "xx"}
+	recorder.known["bill_gates_9.jpg"] = "bill"
+	if err := m.save(c.ManifestPath); err != nil {
+		t.Fatal(err)
+	}
+	sync()
+	if len(recorder.taught) != 0 || len(recorder.removed) != 1 || recorder.removed[0] != "bill_gates_9.jpg" {
+		t.Errorf("expected only bill_gates_9.jpg to be removed; got %v and %v", recorder.taught, recorder.removed)
+	}
+
+	// With reteach every picture should be removed and taught again.
+	c.Reteach = true
+	sync()
+	if len(recorder.taught) != 5 || len(recorder.removed) != 5 {
+		t.Errorf("expected 5 pictures taught and 5 removed; got %v and %v", recorder.taught, recorder.removed)
+	}
+}
+
+func Test_waitForFacebox(t *testing.T) {
+	c, err := newConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.PeopleDir = testPeopleDir
+	c.CoolDownTimeout = time.Second
+
+	desired := newManifest("")
+	desired.Faces["bill_gates_1.jpg"] = manifestEntry{Name: "bill"}
+	desired.Faces["mark_zuckerberg_1.jpg"] = manifestEntry{Name: "mark"}
+	taught := []string{"bill_gates_1.jpg", "mark_zuckerberg_1.jpg"}
+
+	originalInterval, originalFallback := readinessPollInterval, coolDownFallback
+	readinessPollInterval, coolDownFallback = time.Millisecond, time.Millisecond
+	originalFacebox := fbox
+	defer func(original recognizer) {
+		fbox = original
+		readinessPollInterval, coolDownFallback = originalInterval, originalFallback
+	}(originalFacebox)
+
+	// facebox recognizes the pictures only after a few checks.
+	checks := 0
+	fbox = &checkFuncRecognizer{check: func(image io.Reader) ([]facebox.Face, error) {
+		checks++
+		if checks < 5 {
+			return []facebox.Face{{}}, nil
+		}
+		return (&mockRecognizer{}).Check(image)
+	}}
+	start := time.Now()
+	waitForFacebox(c, desired, taught)
+	if checks < 5 {
+		t.Errorf("expected waitForFacebox to check until facebox was ready; got %d checks", checks)
+	}
+	if time.Since(start) >= c.CoolDownTimeout {
+		t.Errorf("waitForFacebox shouldn't wait until the timeout when facebox is ready")
+	}
+
+	// facebox never recognizes the pictures, so we should give up after the timeout.
+	c.CoolDownTimeout = 50 * time.Millisecond
+	fbox = &checkFuncRecognizer{check: func(image io.Reader) ([]facebox.Face, error) {
+		return []facebox.Face{{}}, nil
+	}}
+	start = time.Now()
+	waitForFacebox(c, desired, taught)
+	if time.Since(start) < c.CoolDownTimeout {
+		t.Errorf("waitForFacebox should wait until the timeout when facebox is not ready")
+	}
+
+	// facebox cannot check the pictures, so we should fall back to the fixed cooldown period.
+	c.CoolDownTimeout = time.Minute
+	fbox = &checkFuncRecognizer{check: func(image io.Reader) ([]facebox.Face, error) {
+		return nil, fmt.Errorf("unsupported")
+	}}
+	start = time.Now()
+	waitForFacebox(c, desired, taught)
+	if time.Since(start) >= c.CoolDownTimeout {
+		t.Errorf("waitForFacebox should fall back to the fixed cooldown period when facebox cannot check the pictures")
+	}
+}
@@ -0,0 +1,385 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// ignoreFileName is the name of the gitignore-style files that tell coalescer which files
+// and directories of picsdir it should skip.
+const ignoreFileName = ".coalescerignore"
+
+// stringList is a flag.Value that collects the values of a flag that can be repeated.
+type stringList []string
+
+func (s *stringList) String() string {
+	if s == nil {
+		return ""
+	}
+	return strings.Join(*s, ",")
+}
+
+func (s *stringList) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
+
+// ignoreRule represents a single pattern of a .coalescerignore file, or of the include and
+// exclude flags.
+type ignoreRule struct {
+	// base is the slash separated path, relative to the walked root, of the directory
+	// whose .coalescerignore file holds the rule. It's empty for the root itself.
+	base string
+
+	pattern string
+
+	// negate is true for the patterns that start with !, which bring back what a previous
+	// pattern skipped.
+	negate bool
+
+	// dirOnly is true for the patterns that end with /, which only match directories.
+	dirOnly bool
+
+	// anchored is true for the patterns that contain a /, which match the path relative to
+	// base. The rest of the patterns match the name of a file or directory at any level.
+	anchored bool
+}
+
+// parseIgnoreRule parses a pattern with the gitignore syntax. It returns false if the pattern
+// is a comment or an empty line.
+func parseIgnoreRule(base, pattern string) (ignoreRule, bool) {
+	pattern = strings.TrimSpace(pattern)
+	if pattern == "" || strings.HasPrefix(pattern, "#") {
+		return ignoreRule{}, false
+	}
+	r := ignoreRule{base: base}
+	if strings.HasPrefix(pattern, "!") {
+		r.negate = true
+		pattern = pattern[1:]
+	}
+	if strings.HasSuffix(pattern, "/") {
+		r.dirOnly = true
+		pattern = strings.TrimSuffix(pattern, "/")
+	}
+	if strings.Contains(pattern, "/") {
+		r.anchored = true
+		pattern = strings.TrimPrefix(pattern, "/")
+	}
+	r.pattern = pattern
+	return r, r.pattern != ""
+}
+
+// matches checks whether the rule matches the file or directory with the given slash
+// separated path relative to the walked root.
+func (r ignoreRule) matches(rel string, isDir bool) bool {
+	if r.dirOnly && !isDir {
+		return false
+	}
+	if r.base != "" {
+		if !strings.HasPrefix(rel, r.base+"/") {
+			return false
+		}
+		rel = strings.TrimPrefix(rel, r.base+"/")
+	}
+	if r.anchored {
+		return globMatch(r.pattern, rel)
+	}
+	return globMatch(r.pattern, path.Base(rel))
+}
+
+// matchRules checks whether the last of the given rules that matches the file or directory
+// with the given slash separated path relative to the walked root is not negated, the same
+// way .gitignore files work: a later negated pattern brings back what an earlier one matched.
+func matchRules(rules []ignoreRule, rel string, isDir bool) bool {
+	matched := false
+	for _, r := range rules {
+		if r.matches(rel, isDir) {
+			matched = !r.negate
+		}
+	}
+	return matched
+}
+
+// globMatch checks whether the given slash separated name matches the given pattern. Each
+// segment of the pattern is matched with path.Match, and a ** segment matches any number
+// of segments, including none.
+func globMatch(pattern, name string) bool {
+	return matchSegments(strings.Split(pattern, "/"), strings.Split(name, "/"))
+}
+
+func matchSegments(pattern, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(name); i++ {
+				if matchSegments(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], name[0]); !ok {
+			return false
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0
+}
+
+// validatePattern checks whether the given glob pattern is well formed.
+func validatePattern(pattern string) error {
+	for _, segment := range strings.Split(pattern, "/") {
+		if _, err := path.Match(segment, ""); err != nil {
+			return fmt.Errorf("invalid pattern %q", pattern)
+		}
+	}
+	return nil
+}
+
+// walkFilter decides which files and directories of the walked root coalescer checks,
+// according to the include and exclude flags, the max-depth and skip-hidden flags, and
+// the .coalescerignore files found along the way.
+type walkFilter struct {
+	root       string
+	include    []ignoreRule
+	exclude    []ignoreRule
+	maxDepth   int
+	skipHidden bool
+
+	// ignores maps the directories that were walked to the .coalescerignore rules that apply
+	// to their content, including the rules of their parents.
+	ignores map[string][]ignoreRule
+}
+
+func newWalkFilter(c *config, root string) *walkFilter {
+	f := &walkFilter{
+		root:       filepath.Clean(root),
+		maxDepth:   c.MaxDepth,
+		skipHidden: c.SkipHidden,
+		ignores:    make(map[string][]ignoreRule),
+	}
+	for _, p := range c.Include {
+		if r, ok := parseIgnoreRule("", p); ok {
+			f.include = append(f.include, r)
+		}
+	}
+	for _, p := range c.Exclude {
+		if r, ok := parseIgnoreRule("", p); ok {
+			f.exclude = append(f.exclude, r)
+		}
+	}
+	return f
+}
+
+// skip checks whether the file or directory located in the given path should be skipped.
+// Directories must be given to skip before their content, since that's when their
+// .coalescerignore file is read. Archives are treated as directories, see skipEntry.
+func (f *walkFilter) skip(p string, info os.FileInfo) (bool, error) {
+	rel, err := filepath.Rel(f.root, p)
+	if err != nil {
+		return false, err
+	}
+	rel = filepath.ToSlash(rel)
+	if rel == "." {
+		if !info.IsDir() {
+			return false, nil
+		}
+		return false, f.loadIgnores(p, "")
+	}
+
+	archive := info.Mode().IsRegular() && isArchive(info.Name())
+	isDir := info.IsDir() || archive
+	if f.skipHidden && strings.HasPrefix(info.Name(), ".") {
+		return true, nil
+	}
+	if !info.IsDir() && info.Name() == ignoreFileName {
+		return true, nil
+	}
+	depth := strings.Count(rel, "/") + 1
+	if f.maxDepth > 0 && isDir && depth >= f.maxDepth {
+		return true, nil
+	}
+
+	if matchRules(f.exclude, rel, isDir) || matchRules(f.ignores[filepath.Dir(p)], rel, isDir) {
+		return true, nil
+	}
+
+	if info.IsDir() {
+		return false, f.loadIgnores(p, rel)
+	}
+	if archive {
+		return false, nil
+	}
+	return !f.included(rel), nil
+}
+
+// skipEntry checks whether the file inside an archive located in the given path should be
+// skipped, as if the archive was a directory. The .coalescerignore files don't apply to
+// the content of archives. A nil walkFilter doesn't skip anything.
+func (f *walkFilter) skipEntry(p string) bool {
+	if f == nil {
+		return false
+	}
+	rel, err := filepath.Rel(f.root, p)
+	if err != nil {
+		return false
+	}
+	segments := strings.Split(filepath.ToSlash(rel), "/")
+	if f.maxDepth > 0 && len(segments) > f.maxDepth {
+		return true
+	}
+	for i := range segments {
+		if f.skipHidden && strings.HasPrefix(segments[i], ".") {
+			return true
+		}
+		ancestor := strings.Join(segments[:i+1], "/")
+		if matchRules(f.exclude, ancestor, i < len(segments)-1) {
+			return true
+		}
+	}
+	return !f.included(strings.Join(segments, "/"))
+}
+
+// included checks whether the file with the given slash separated path relative to the walked
+// root matches the include patterns, if there are any.
+func (f *walkFilter) included(rel string) bool {
+	if len(f.include) == 0 {
+		return true
+	}
+	return matchRules(f.include, rel, false)
+}
+
+// loadIgnores reads the .coalescerignore file of the directory located in the given path,
+// whose slash separated path relative to the walked root is rel, if there is one.
+func (f *walkFilter) loadIgnores(dir, rel string) error {
+	dir = filepath.Clean(dir)
+	rules := f.ignores[filepath.Dir(dir)]
+	if rel == "" {
+		rules = nil
+	}
+	file, err := os.Open(filepath.Join(dir, ignoreFileName))
+	if os.IsNotExist(err) {
+		f.ignores[dir] = rules
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	// The rules of the parents shouldn't be modified by the rules of this directory.
+	rules = append([]ignoreRule(nil), rules...)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if r, ok := parseIgnoreRule(rel, scanner.Text()); ok {
+			rules = append(rules, r)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("couldn't read %s; got error %s", filepath.Join(dir, ignoreFileName), err)
+	}
+	f.ignores[dir] = rules
+	return nil
+}
+
+// stdin is where coalescer reads the list of paths from when the files-from flag is -.
+var stdin io.Reader = os.Stdin
+
+// inputPaths starts a goroutine that sends each file coalescer should check on the item
+// channel: the files of each picsdir, one picsdir after another, followed by the files
+// listed in config.FilesFrom. The files inside archives are sent too, see sendArchive.
+// It sends the result on the error channel. If done is closed, inputPaths abandons its work.
+func inputPaths(c *config, done <-chan struct{}) (<-chan item, <-chan error) {
+	items := make(chan item)
+	errc := make(chan error, 1)
+	send := func(it item) error {
+		_metrics.filesDiscovered.inc("")
+		select {
+		case items <- it:
+			return nil
+		case <-done:
+			return errors.New("walk canceled")
+		}
+	}
+	go func() {
+		defer close(items)
+		errc <- func() error {
+			for _, root := range c.PicsDirs {
+				rootItems, rootErrc := walkFiles(c, done, root, newWalkFilter(c, root))
+				for it := range rootItems {
+					if err := send(it); err != nil {
+						return err
+					}
+				}
+				if err := <-rootErrc; err != nil {
+					return err
+				}
+			}
+			if c.FilesFrom == "" {
+				return nil
+			}
+			list, err := readPathList(c)
+			if err != nil {
+				return err
+			}
+			for _, path := range list {
+				info, err := os.Stat(c.resolve(path))
+				// Lists made with find usually include the directories too.
+				if err == nil && info.IsDir() {
+					continue
+				}
+				if err == nil && info.Mode().IsRegular() && isArchive(path) {
+					if err := sendArchive(c, path, nil, send); err != nil {
+						return fmt.Errorf("couldn't read the archive %s; got error %s", path, err)
+					}
+					continue
+				}
+				if err := send(item{path: path}); err != nil {
+					return err
+				}
+			}
+			return nil
+		}()
+	}()
+	return items, errc
+}
+
+// readPathList reads the list of paths in config.FilesFrom, or in the standard input if it's -.
+// The paths are separated by NUL characters if there is any, like the output of find -print0,
+// and by new lines otherwise.
+func readPathList(c *config) ([]string, error) {
+	var b []byte
+	var err error
+	if c.FilesFrom == "-" {
+		b, err = ioutil.ReadAll(stdin)
+	} else {
+		b, err = ioutil.ReadFile(c.resolve(c.FilesFrom))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read the list of paths; got error %s", err)
+	}
+
+	sep := "\n"
+	if bytes.IndexByte(b, 0) >= 0 {
+		sep = "\x00"
+	}
+	var paths []string
+	for _, path := range strings.Split(string(b), sep) {
+		if sep == "\n" {
+			path = strings.TrimSuffix(path, "\r")
+		}
+		if path != "" {
+			paths = append(paths, path)
+		}
+	}
+	return paths, nil
+}
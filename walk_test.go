@@ -0,0 +1,210 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func Test_globMatch(t *testing.T) {
+	tests := []struct {
+		pattern string
+		name    string
+		want    bool
+	}{
+		{"*.jpg", "a.jpg", true},
+		{"*.jpg", "a.png", false},
+		{"2020/*.jpg", "2020/a.jpg", true},
+		{"2020/*.jpg", "2020/trip/a.jpg", false},
+		{"2020/**", "2020/trip/a.jpg", true},
+		{"**/@eaDir", "2020/trip/@eaDir", true},
+		{"**/@eaDir", "@eaDir", true},
+		{"a/**/b", "a/b", true},
+		{"a/**/b", "a/x/y/b", true},
+		{"a/**/b", "a/x/y/c", false},
+	}
+	for _, tt := range tests {
+		if got := globMatch(tt.pattern, tt.name); got != tt.want {
+			t.Errorf("globMatch(%q, %q) = %v; want %v", tt.pattern, tt.name, got, tt.want)
+		}
+	}
+}
+
+func Test_walkFiles_with_filter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "coalescer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"a.jpg":                     "",
+		"b.png":                     "",
+		"notes.txt":                 "",
+		".hidden.jpg":               "",
+		"@eaDir/a.jpg/thumb.jpg":    "",
+		"2020/c.jpg":                "",
+		"2020/d.jpg":                "",
+		"2020/raw/e.jpg":            "",
+		"2020/.coalescerignore":     "# keep the raw pictures out\nraw/\n*.jpg\n!c.jpg\n",
+		"2021/f.jpg":                "",
+		".trash/g.jpg":              "",
+		"2021/deep/deeper/h.jpg":    "",
+		"2021/deep/deeper/skip.png": "",
+	}
+	for name, content := range files {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	walk := func(c *config) []string {
+		done := make(chan struct{})
+		defer close(done)
+		paths, errc := walkFiles(c, done, dir, newWalkFilter(c, dir))
+		var got []string
+		for p := range paths {
+			rel, err := filepath.Rel(dir, p.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, filepath.ToSlash(rel))
+		}
+		if err := <-errc; err != nil {
+			t.Fatalf("walkFiles shouldn't fail; got error %s", err)
+		}
+		sort.Strings(got)
+		return got
+	}
+
+	tests := []struct {
+		name string
+		conf config
+		want []string
+	}{
+		{
+			name: "exclude and skip hidden",
+			conf: config{Exclude: stringList{"@eaDir"}, SkipHidden: true},
+			want: []string{"2020/c.jpg", "2021/deep/deeper/h.jpg", "2021/deep/deeper/skip.png", "2021/f.jpg", "a.jpg", "b.png", "notes.txt"},
+		},
+		{
+			name: "include",
+			conf: config{Include: stringList{"*.jpg"}, Exclude: stringList{"@eaDir/"}, SkipHidden: true},
+			want: []string{"2020/c.jpg", "2021/deep/deeper/h.jpg", "2021/f.jpg", "a.jpg"},
+		},
+		{
+			name: "anchored include",
+			conf: config{Include: stringList{"2021/**/*.jpg"}},
+			want: []string{"2021/deep/deeper/h.jpg", "2021/f.jpg"},
+		},
+		{
+			name: "negated exclude",
+			conf: config{Exclude: stringList{"*.jpg", "!a.jpg", "@eaDir", ".*"}},
+			want: []string{"2021/deep/deeper/skip.png", "a.jpg", "b.png", "notes.txt"},
+		},
+		{
+			name: "negated include",
+			conf: config{Include: stringList{"*.jpg", "!f.jpg"}, Exclude: stringList{"@eaDir", ".*"}},
+			want: []string{"2020/c.jpg", "2021/deep/deeper/h.jpg", "a.jpg"},
+		},
+		{
+			name: "max depth",
+			conf: config{MaxDepth: 2, Exclude: stringList{"@eaDir", ".trash"}},
+			want: []string{".hidden.jpg", "2020/c.jpg", "2021/f.jpg", "a.jpg", "b.png", "notes.txt"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := walk(&tt.conf); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("expected the files %v; got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func Test_inputPaths(t *testing.T) {
+	dir, err := ioutil.TempDir("", "coalescer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{"a/1.jpg", "a/2.jpg", "b/3.jpg", "c/4.jpg", "c/5 with spaces.jpg"} {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c, err := newConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.PicsDirs = stringList{filepath.Join(dir, "a"), filepath.Join(dir, "b")}
+	c.FilesFrom = "-"
+
+	// Like the output of find -print0, including a directory.
+	list := filepath.Join(dir, "c") + "\x00" + filepath.Join(dir, "c", "4.jpg") + "\x00" + filepath.Join(dir, "c", "5 with spaces.jpg") + "\x00"
+	originalStdin := stdin
+	stdin = strings.NewReader(list)
+	defer func() {
+		stdin = originalStdin
+	}()
+
+	done := make(chan struct{})
+	defer close(done)
+	paths, errc := inputPaths(c, done)
+	var got []string
+	for p := range paths {
+		got = append(got, p.path)
+	}
+	if err := <-errc; err != nil {
+		t.Fatalf("inputPaths shouldn't fail; got error %s", err)
+	}
+
+	var want []string
+	for _, name := range []string{"a/1.jpg", "a/2.jpg", "b/3.jpg", "c/4.jpg", "c/5 with spaces.jpg"} {
+		want = append(want, filepath.Join(dir, filepath.FromSlash(name)))
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected the paths %v; got %v", want, got)
+	}
+
+	// Absolute paths shouldn't be joined to the working dir.
+	if c.resolve(want[0]) != want[0] {
+		t.Errorf("expected the absolute path %s to be left untouched; got %s", want[0], c.resolve(want[0]))
+	}
+}
+
+func Test_readPathList_with_new_lines(t *testing.T) {
+	c, err := newConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.FilesFrom = "-"
+	originalStdin := stdin
+	stdin = strings.NewReader("pics/a.jpg\r\npics/b.jpg\n\npics/c.jpg")
+	defer func() {
+		stdin = originalStdin
+	}()
+
+	got, err := readPathList(c)
+	if err != nil {
+		t.Fatalf("readPathList shouldn't fail; got error %s", err)
+	}
+	want := []string{"pics/a.jpg", "pics/b.jpg", "pics/c.jpg"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected the paths %v; got %v", want, got)
+	}
+}